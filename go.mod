@@ -0,0 +1,10 @@
+module github.com/birthtothunder/Letterboxd-Top-Movies-as-Rated-by-Friends
+
+go 1.25.0
+
+require github.com/PuerkitoBio/goquery v1.13.0
+
+require (
+	github.com/andybalholm/cascadia v1.3.4 // indirect
+	golang.org/x/net v0.58.0 // indirect
+)
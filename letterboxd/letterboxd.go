@@ -0,0 +1,2933 @@
+// Package letterboxd ranks the movies rated by the friends of a Letterboxd
+// user. Aggregate collects the friends' ratings and returns them combined
+// and ranked, the command in the repository root adds the prompts and the
+// output formats.
+package letterboxd
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+// Movie represents a movie with its URL and the rating a user gave it
+type Movie struct {
+	URL     string
+	Rating  int
+	User    string
+	Watched time.Time
+	FilmID  string // Letterboxd's id of the film, which stays when the link changes
+}
+
+// MovieWithRatings represents a movie with multiple ratings, Users[i]
+// gave Ratings[i]
+type MovieWithRatings struct {
+	URL     string
+	Ratings []int
+	Users   []string
+}
+
+// Result represents the processed movie data for display. Ratings are
+// kept on Letterboxd's internal 1-10 scale, where 10 means five stars,
+// and only converted to stars for display and saving. Raters[i] gave
+// Ratings[i].
+type Result struct {
+	AvgRating      float64
+	Median         float64
+	Mode           int
+	WeightedRating float64
+	RMSRating      float64
+	WeightedAvg    float64
+	Controversy    float64
+	GemScore       float64
+	BayesianRating float64
+	SimilarAvg     float64
+	MyRating       int
+	LovedBy        int
+	VoteCount      int
+	URL            string
+	Ratings        []int
+	Raters         []string
+	Title          string
+	Year           int
+	Genres         []string
+	Runtime        int
+	TMDBID         int
+	TMDBType       string
+	GlobalRatings  int
+	Poster         string
+	Overview       string
+}
+
+// SortMetrics maps the names accepted by -sort to their description
+var SortMetrics = map[string]string{
+	"bayes":       "Bayesian average",
+	"avg":         "average rating",
+	"weighted":    "weighted score",
+	"rms":         "root mean square rating",
+	"count":       "average weighted by each friend's number of ratings",
+	"controversy": "controversy (spread of the ratings)",
+	"gems":        "hidden gem score",
+	"votes":       "number of votes",
+	"similar":     "average weighted by each friend's similarity to you",
+}
+
+// comparators maps the names accepted by -sort to the comparison of
+// results[i] and results[j] for sort.Slice
+var comparators = map[string]func(results []Result) func(i, j int) bool{
+	"bayes":       byBayes,
+	"avg":         byAvg,
+	"weighted":    byWeighted,
+	"rms":         byRMS,
+	"count":       byCount,
+	"controversy": byControversy,
+	"gems":        byGems,
+	"votes":       byVotes,
+	"similar":     bySimilar,
+}
+
+// byValue ranks the results by a value from high to low, ties are broken
+// by the number of votes and then by URL, so the order is the same on
+// every run
+func byValue(results []Result, value func(r Result) float64) func(i, j int) bool {
+	return func(i, j int) bool {
+		vi, vj := value(results[i]), value(results[j])
+		if vi != vj {
+			return vi > vj
+		}
+		if results[i].VoteCount != results[j].VoteCount {
+			return results[i].VoteCount > results[j].VoteCount
+		}
+		return results[i].URL < results[j].URL
+	}
+}
+
+func byBayes(results []Result) func(i, j int) bool {
+	return byValue(results, func(r Result) float64 { return r.BayesianRating })
+}
+
+func byAvg(results []Result) func(i, j int) bool {
+	return byValue(results, func(r Result) float64 { return r.AvgRating })
+}
+
+func byWeighted(results []Result) func(i, j int) bool {
+	return byValue(results, func(r Result) float64 { return r.WeightedRating })
+}
+
+func byRMS(results []Result) func(i, j int) bool {
+	return byValue(results, func(r Result) float64 { return r.RMSRating })
+}
+
+func byCount(results []Result) func(i, j int) bool {
+	return byValue(results, func(r Result) float64 { return r.WeightedAvg })
+}
+
+func byControversy(results []Result) func(i, j int) bool {
+	return byValue(results, func(r Result) float64 { return r.Controversy })
+}
+
+func byGems(results []Result) func(i, j int) bool {
+	return byValue(results, func(r Result) float64 { return r.GemScore })
+}
+
+func bySimilar(results []Result) func(i, j int) bool {
+	return byValue(results, func(r Result) float64 { return r.SimilarAvg })
+}
+
+// byVotes ranks the results by their number of votes, ties are broken
+// by the average rating and then by URL
+func byVotes(results []Result) func(i, j int) bool {
+	return func(i, j int) bool {
+		if results[i].VoteCount != results[j].VoteCount {
+			return results[i].VoteCount > results[j].VoteCount
+		}
+		if results[i].AvgRating != results[j].AvgRating {
+			return results[i].AvgRating > results[j].AvgRating
+		}
+		return results[i].URL < results[j].URL
+	}
+}
+
+// Stars converts a rating on the 1-10 scale to stars
+func Stars(rating float64) float64 {
+	return rating / 2
+}
+
+// StarList converts ratings on the 1-10 scale to stars
+func StarList(list []int) []float64 {
+	converted := make([]float64, len(list))
+	for i, r := range list {
+		converted[i] = Stars(float64(r))
+	}
+	return converted
+}
+
+// Helper functions for calculations
+func avg(list []int) float64 {
+	if len(list) == 0 {
+		return 0
+	}
+	sum := 0
+	for _, v := range list {
+		sum += v
+	}
+	return float64(sum) / float64(len(list))
+}
+
+func leastSquare(list []int) float64 {
+	if len(list) == 0 {
+		return 0
+	}
+	sum := 0
+	for _, v := range list {
+		sum += v * v
+	}
+	return math.Sqrt(float64(sum) / float64(len(list)))
+}
+
+func median(list []int) float64 {
+	if len(list) == 0 {
+		return 0
+	}
+	sorted := append([]int(nil), list...)
+	sort.Ints(sorted)
+	mid := len(sorted) / 2
+	if len(sorted)%2 == 0 {
+		return float64(sorted[mid-1]+sorted[mid]) / 2
+	}
+	return float64(sorted[mid])
+}
+
+// stdDev returns the population standard deviation of the ratings
+func stdDev(list []int) float64 {
+	if len(list) == 0 {
+		return 0
+	}
+	mean := avg(list)
+	sum := 0.0
+	for _, v := range list {
+		sum += (float64(v) - mean) * (float64(v) - mean)
+	}
+	return math.Sqrt(sum / float64(len(list)))
+}
+
+// Pearson returns the Pearson correlation of two equally long lists of
+// ratings, from -1 to 1. It is 0 if either list has no spread.
+func Pearson(x []int, y []int) float64 {
+	if len(x) == 0 || len(x) != len(y) {
+		return 0
+	}
+	meanX, meanY := avg(x), avg(y)
+	cov, varX, varY := 0.0, 0.0, 0.0
+	for i := range x {
+		dx, dy := float64(x[i])-meanX, float64(y[i])-meanY
+		cov += dx * dy
+		varX += dx * dx
+		varY += dy * dy
+	}
+	if varX == 0 || varY == 0 {
+		return 0
+	}
+	return cov / math.Sqrt(varX*varY)
+}
+
+// bayesian pulls an average of votes ratings towards the global mean,
+// as if minVotes extra votes of the global mean were cast
+func bayesian(average float64, votes int, minVotes float64, globalMean float64) float64 {
+	v := float64(votes)
+	if v+minVotes == 0 {
+		return globalMean
+	}
+	return v/(v+minVotes)*average + minVotes/(v+minVotes)*globalMean
+}
+
+// gemPrior is the number of votes of the global mean hidden gems are
+// pulled towards, small enough that a film loved by one friend still
+// ranks high
+const gemPrior = 1
+
+// mode returns the most frequent rating, preferring the higher rating on ties
+func mode(list []int) int {
+	counts := make(map[int]int)
+	best, bestCount := 0, 0
+	for _, v := range list {
+		counts[v]++
+		if counts[v] > bestCount || (counts[v] == bestCount && v > best) {
+			best, bestCount = v, counts[v]
+		}
+	}
+	return best
+}
+
+// countWeight is the weight of a rating by a user who rated count films
+// in total: 1 + ln(1 + count). It grows slowly, so a friend with 5000
+// ratings counts about twice as much as one with 50.
+func countWeight(count int) float64 {
+	return 1 + math.Log1p(float64(max(count, 0)))
+}
+
+// countWeightedAvg averages the ratings, weighting each by the total
+// number of films its user rated
+func countWeightedAvg(ratings []int, users []string, movieCounts map[string]int) float64 {
+	if len(ratings) == 0 || len(users) != len(ratings) {
+		return avg(ratings)
+	}
+	sum, weights := 0.0, 0.0
+	for i, r := range ratings {
+		w := countWeight(movieCounts[users[i]])
+		sum += w * float64(r)
+		weights += w
+	}
+	return sum / weights
+}
+
+// weighted scores the ratings from 0 to 100, a five-star rating (10)
+// scores 100 and ratings of one and a half stars or less score nothing.
+// Ratings outside 1-10 are ignored.
+func weighted(list []int) float64 {
+	if len(list) == 0 {
+		return 0
+	}
+	// weights is indexed by the rating, index 0 is unused
+	weights := []int{0, 0, 0, 0, 5, 20, 40, 65, 80, 95, 100}
+	wList := make([]int, 0, len(list))
+	for _, i := range list {
+		if i >= 1 && i < len(weights) {
+			wList = append(wList, weights[i])
+		}
+	}
+	return avg(wList)
+}
+
+// Level is the verbosity of a Logger
+type Level int
+
+const (
+	LevelError Level = iota
+	LevelWarn
+	LevelInfo
+	LevelDebug
+)
+
+// slogLevels maps the Levels to the levels of their slog records
+var slogLevels = map[Level]slog.Level{
+	LevelError: slog.LevelError,
+	LevelWarn:  slog.LevelWarn,
+	LevelInfo:  slog.LevelInfo,
+	LevelDebug: slog.LevelDebug,
+}
+
+// Logger writes progress messages to stdout and warnings and errors to
+// stderr, dropping everything above its level. Structured records, e.g.
+// about every request, go to stderr as key=value text. With JSON every
+// message is a JSON record on stderr instead, so stdout only gets the
+// results. The setters rebuild the slog.Logger every message goes through.
+type Logger struct {
+	out    io.Writer
+	err    io.Writer
+	level  slog.LevelVar
+	json   bool
+	logger *slog.Logger
+}
+
+// NewLogger returns a Logger printing everything to stdout and stderr
+func NewLogger() *Logger {
+	l := &Logger{out: os.Stdout, err: os.Stderr}
+	l.SetLevel(LevelInfo)
+	l.configure()
+	return l
+}
+
+// Log is used for all progress and error messages
+var Log = NewLogger()
+
+// SetOutput sets where progress messages and everything else are written
+func (l *Logger) SetOutput(out, err io.Writer) {
+	l.out, l.err = out, err
+	l.configure()
+}
+
+// SetLevel drops the messages above level
+func (l *Logger) SetLevel(level Level) {
+	l.level.Set(slogLevels[level])
+}
+
+// SetJSON switches between plain messages and JSON records
+func (l *Logger) SetJSON(json bool) {
+	l.json = json
+	l.configure()
+}
+
+// configure builds the slog.Logger for the current output and format,
+// the level is shared with it so SetLevel needn't rebuild it
+func (l *Logger) configure() {
+	opts := &slog.HandlerOptions{Level: &l.level}
+	var handler slog.Handler = slog.NewTextHandler(l.err, opts)
+	if l.json {
+		handler = slog.NewJSONHandler(l.err, opts)
+	}
+	l.logger = slog.New(handler)
+}
+
+// Infof prints a progress message
+func (l *Logger) Infof(format string, args ...any) {
+	l.printf(LevelInfo, l.out, format, args...)
+}
+
+// Debugf prints a diagnostic message for tracking down scraping problems
+func (l *Logger) Debugf(format string, args ...any) {
+	l.printf(LevelDebug, l.err, format, args...)
+}
+
+// Warnf prints a warning
+func (l *Logger) Warnf(format string, args ...any) {
+	l.printf(LevelWarn, l.err, format, args...)
+}
+
+// Errorf prints an error
+func (l *Logger) Errorf(format string, args ...any) {
+	l.printf(LevelError, l.err, format, args...)
+}
+
+// Debug logs a structured diagnostic record with the given key-value
+// pairs, e.g. Debug("fetch", "url", url)
+func (l *Logger) Debug(msg string, args ...any) {
+	l.logger.Log(context.Background(), slog.LevelDebug, msg, args...)
+}
+
+// printf prints a message, or logs it as a record with JSON. Progress
+// lines that are redrawn with "\r" are left out of the JSON log.
+func (l *Logger) printf(level Level, w io.Writer, format string, args ...any) {
+	ctx := context.Background()
+	if !l.logger.Enabled(ctx, slogLevels[level]) {
+		return
+	}
+	if !l.json {
+		fmt.Fprintf(w, format, args...)
+		return
+	}
+	msg := fmt.Sprintf(format, args...)
+	if strings.HasPrefix(msg, "\r") {
+		return
+	}
+	if msg = strings.TrimSpace(msg); msg != "" {
+		l.logger.Log(ctx, slogLevels[level], msg)
+	}
+}
+
+// Fetcher fetches and parses web pages, retrying on failure with an
+// exponential backoff starting at RetryDelay and capped at MaxDelay.
+// RateLimit caps the requests per second across all goroutines sharing
+// the Fetcher, zero means no limit. If CacheDir is set, fetched pages are
+// kept there and reused until they are older than CacheTTL. Pages are
+// requested from BaseURL, which can point to a local server. Every
+// request is sent with UserAgent, and with CheckRobots a warning is shown
+// for pages the site's robots.txt disallows. Pages Validate rejects are
+// retried and never cached. At most
+// MaxConcurrent requests run at the same time, a limit that is halved
+// whenever Letterboxd limits the requests and grows back by one after
+// every growAfter answered requests.
+type Fetcher struct {
+	BaseURL       string
+	Timeout       time.Duration
+	MaxRetries    int
+	RetryDelay    time.Duration
+	MaxDelay      time.Duration
+	RateLimit     float64
+	CacheDir      string
+	CacheTTL      time.Duration
+	UserAgent     string
+	CheckRobots   bool
+	Validate      func(*goquery.Document) bool
+	Log           *Logger
+	MaxConcurrent int
+
+	mu          sync.Mutex
+	pausedUntil time.Time
+	nextRequest time.Time
+	robotsOnce  sync.Once
+	disallowed  []*regexp.Regexp
+	warned      map[string]bool
+	slotsOnce   sync.Once
+	slots       chan struct{}
+	limit       int
+	withheld    int
+	successes   int
+}
+
+// growAfter is the number of answered requests after which the request
+// limit of a Fetcher grows by one again
+const growAfter = 20
+
+// NewFetcher returns a Fetcher with the default settings
+func NewFetcher() *Fetcher {
+	return &Fetcher{
+		BaseURL:       "https://letterboxd.com",
+		Timeout:       10 * time.Second,
+		MaxRetries:    10,
+		RetryDelay:    500 * time.Millisecond,
+		MaxDelay:      30 * time.Second,
+		CacheTTL:      24 * time.Hour,
+		UserAgent:     defaultUserAgent,
+		CheckRobots:   true,
+		Validate:      isLetterboxdPage,
+		Log:           Log,
+		MaxConcurrent: 12,
+	}
+}
+
+// defaultUserAgent identifies the requests of this program
+const defaultUserAgent = "Letterboxd-Top-Movies-as-Rated-by-Friends (+https://github.com/birthtothunder/Letterboxd-Top-Movies-as-Rated-by-Friends)"
+
+// DefaultFetcher is used for every request to Letterboxd
+var DefaultFetcher = NewFetcher()
+
+var (
+	errNotFound    = errors.New("page not found")
+	errRateLimited = errors.New("rate limited by Letterboxd")
+	errGaveUp      = errors.New("gave up after all retries")
+	errInvalidPage = errors.New("the page is incomplete or no Letterboxd page")
+	errGated       = errors.New("the page requires signing in or confirming your age")
+)
+
+// isGatePage reports if a request ended on a sign-in or age confirmation
+// page instead of the requested one
+func isGatePage(path string, doc *goquery.Document) bool {
+	if strings.HasPrefix(path, "/sign-in") || strings.HasPrefix(path, "/user/login") {
+		return true
+	}
+	return doc.Find("form#signin-form, form.js-signin-form, .age-gate, #age-gate").Length() > 0
+}
+
+// isLetterboxdPage reports if a page looks like a complete Letterboxd
+// page, so a truncated or foreign response isn't mistaken for an empty
+// list
+func isLetterboxdPage(doc *goquery.Document) bool {
+	if doc.Find("body").Children().Length() == 0 {
+		return false
+	}
+	site := doc.Find(`meta[property="og:site_name"]`).AttrOr("content", "") + doc.Find("head title").Text()
+	return strings.Contains(strings.ToLower(site), "letterboxd")
+}
+
+// Get fetches and parses a web page. A missing page returns errNotFound
+// and a sign-in or age confirmation wall errGated right away, while rate
+// limiting (429) and unavailability (503) pause all requests of the
+// Fetcher for an extended backoff. Other statuses are retried like
+// connection problems. Waiting and requests are given up as soon as ctx
+// is done.
+func (f *Fetcher) Get(ctx context.Context, url string) (*goquery.Document, error) {
+	if doc, ok := f.readCache(url); ok {
+		return doc, nil
+	}
+	if f.CheckRobots {
+		f.checkRobots(ctx, url)
+	}
+
+	client := &http.Client{
+		Timeout: f.Timeout,
+	}
+
+	err := errors.New("no connection available")
+	for retry := 0; retry < f.MaxRetries; retry++ {
+		if err := f.waitPause(ctx); err != nil {
+			return nil, err
+		}
+		if err := f.throttle(ctx); err != nil {
+			return nil, err
+		}
+		delay := f.backoff(retry)
+
+		req, reqErr := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if reqErr != nil {
+			return nil, reqErr
+		}
+		if f.UserAgent != "" {
+			req.Header.Set("User-Agent", f.UserAgent)
+		}
+		f.Log.Debug("fetch", "url", url, "attempt", retry+1)
+		resp, body, reqErr := f.do(ctx, client, req)
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if reqErr == nil {
+			f.Log.Debug("response", "url", url, "status", resp.StatusCode)
+			f.adapt(resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable)
+			switch resp.StatusCode {
+			case http.StatusOK:
+				doc, parseErr := goquery.NewDocumentFromReader(bytes.NewReader(body))
+				if parseErr == nil && isGatePage(resp.Request.URL.Path, doc) {
+					return nil, errGated
+				}
+				if parseErr != nil || (f.Validate != nil && !f.Validate(doc)) {
+					// A broken page is retried like a failed request
+					err = errInvalidPage
+					break
+				}
+				f.writeCache(url, body)
+				return doc, nil
+			case http.StatusNotFound:
+				return nil, errNotFound
+			case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+				delay = f.backoff(retry + 2)
+				if after, ok := retryAfter(resp.Header.Get("Retry-After")); ok {
+					delay = max(delay, after)
+				}
+				f.pause(delay)
+				err = errRateLimited
+				f.Log.Debug("rate limited", "url", url, "status", resp.StatusCode, "pause", delay)
+				if retry+1 < f.MaxRetries {
+					f.Log.Warnf("Letterboxd is limiting requests, pausing for %s\n", delay.Round(time.Millisecond))
+					if err := sleep(ctx, delay); err != nil {
+						return nil, err
+					}
+				}
+				continue
+			default:
+				err = fmt.Errorf("unexpected status %s", resp.Status)
+			}
+		} else {
+			err = reqErr
+		}
+
+		if retry+1 < f.MaxRetries {
+			f.Log.Debug("retry", "url", url, "attempt", retry+1, "delay", delay, "err", err)
+			f.Log.Warnf("Connection problem, retrying in %s\n", delay.Round(time.Millisecond))
+			if err := sleep(ctx, delay); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return nil, fmt.Errorf("%w: %w", errGaveUp, err)
+}
+
+// do sends a request in one of the Fetcher's request slots and reads the
+// whole answer before the slot is given back. Compressed answers are
+// asked for and decoded here, as Go's transport only decodes gzip when
+// it set Accept-Encoding itself.
+func (f *Fetcher) do(ctx context.Context, client *http.Client, req *http.Request) (*http.Response, []byte, error) {
+	if err := f.acquire(ctx); err != nil {
+		return nil, nil, err
+	}
+	defer f.release()
+
+	req.Header.Set("Accept-Encoding", "gzip, deflate")
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	reader, err := decodeBody(resp)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer reader.Close()
+	body, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	return resp, body, nil
+}
+
+// decodeBody returns a reader of the decoded body of a response sent
+// with gzip, deflate or no Content-Encoding
+func decodeBody(resp *http.Response) (io.ReadCloser, error) {
+	switch strings.ToLower(strings.TrimSpace(resp.Header.Get("Content-Encoding"))) {
+	case "", "identity":
+		return io.NopCloser(resp.Body), nil
+	case "gzip", "x-gzip":
+		return gzip.NewReader(resp.Body)
+	case "deflate":
+		// Deflate is meant to be zlib wrapped, but some servers send it raw
+		buffered := bufio.NewReader(resp.Body)
+		if header, err := buffered.Peek(2); err == nil && (uint16(header[0])<<8|uint16(header[1]))%31 == 0 && header[0]&0x0f == 8 {
+			return zlib.NewReader(buffered)
+		}
+		return flate.NewReader(buffered), nil
+	}
+	return nil, fmt.Errorf("unsupported Content-Encoding \"%s\"", resp.Header.Get("Content-Encoding"))
+}
+
+// acquire takes a request slot, waiting while all of them are in use
+func (f *Fetcher) acquire(ctx context.Context) error {
+	if f.MaxConcurrent <= 0 {
+		return nil
+	}
+	f.slotsOnce.Do(func() {
+		f.slots = make(chan struct{}, f.MaxConcurrent)
+		f.limit = f.MaxConcurrent
+	})
+
+	select {
+	case f.slots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// release gives a request slot back. Slots above the current limit are
+// kept occupied instead, so fewer requests run at the same time.
+func (f *Fetcher) release() {
+	if f.MaxConcurrent <= 0 {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.withheld < f.MaxConcurrent-f.limit {
+		f.withheld++
+		return
+	}
+	<-f.slots
+}
+
+// adapt halves the request limit when Letterboxd limits the requests and
+// raises it by one after growAfter answered requests in a row
+func (f *Fetcher) adapt(limited bool) {
+	if f.MaxConcurrent <= 0 {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if limited {
+		f.successes = 0
+		if f.limit > 1 {
+			f.limit = max(f.limit/2, 1)
+			f.Log.Debug("concurrency", "limit", f.limit)
+		}
+		return
+	}
+
+	f.successes++
+	if f.successes < growAfter || f.limit >= f.MaxConcurrent {
+		return
+	}
+	f.successes = 0
+	f.limit++
+	if f.withheld > 0 {
+		// A withheld slot is always occupied, so this never blocks
+		f.withheld--
+		<-f.slots
+	}
+	f.Log.Debug("concurrency", "limit", f.limit)
+}
+
+// URL returns the full URL of a path on the site, e.g. "/film/<slug>/"
+func (f *Fetcher) URL(path string) string {
+	return f.BaseURL + path
+}
+
+// cachePath returns the file a page is cached in
+func (f *Fetcher) cachePath(url string) string {
+	sum := sha256.Sum256([]byte(url))
+	return filepath.Join(f.CacheDir, hex.EncodeToString(sum[:])+".html.gz")
+}
+
+// readCache returns the cached page if there is a fresh one
+func (f *Fetcher) readCache(url string) (*goquery.Document, bool) {
+	if f.CacheDir == "" {
+		return nil, false
+	}
+
+	path := f.cachePath(url)
+	info, err := os.Stat(path)
+	if err != nil || (f.CacheTTL > 0 && time.Since(info.ModTime()) > f.CacheTTL) {
+		return nil, false
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, false
+	}
+	defer file.Close()
+
+	reader, err := gzip.NewReader(file)
+	if err != nil {
+		return nil, false
+	}
+	defer reader.Close()
+
+	doc, err := goquery.NewDocumentFromReader(reader)
+	if err != nil {
+		return nil, false
+	}
+	return doc, true
+}
+
+// writeCache stores a page in the cache, failures only cost a refetch
+func (f *Fetcher) writeCache(url string, body []byte) {
+	if f.CacheDir == "" {
+		return
+	}
+	if err := os.MkdirAll(f.CacheDir, 0o755); err != nil {
+		return
+	}
+
+	// Write to a temporary file first so readers never see half a page
+	tmp, err := os.CreateTemp(f.CacheDir, "page-*.tmp")
+	if err != nil {
+		return
+	}
+	writer := gzip.NewWriter(tmp)
+	_, err = writer.Write(body)
+	if closeErr := writer.Close(); err == nil {
+		err = closeErr
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return
+	}
+	os.Rename(tmp.Name(), f.cachePath(url))
+}
+
+// pause holds back every request of the Fetcher for the given duration
+func (f *Fetcher) pause(d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if until := time.Now().Add(d); until.After(f.pausedUntil) {
+		f.pausedUntil = until
+	}
+}
+
+// waitPause blocks while the Fetcher is paused
+func (f *Fetcher) waitPause(ctx context.Context) error {
+	f.mu.Lock()
+	wait := time.Until(f.pausedUntil)
+	f.mu.Unlock()
+	return sleep(ctx, wait)
+}
+
+// throttle blocks until the rate limit allows the next request
+func (f *Fetcher) throttle(ctx context.Context) error {
+	if f.RateLimit <= 0 {
+		return nil
+	}
+	interval := time.Duration(float64(time.Second) / f.RateLimit)
+
+	f.mu.Lock()
+	slot := f.nextRequest
+	if now := time.Now(); slot.Before(now) {
+		slot = now
+	}
+	f.nextRequest = slot.Add(interval)
+	f.mu.Unlock()
+
+	return sleep(ctx, time.Until(slot))
+}
+
+// checkRobots warns once per rule if the site's robots.txt disallows
+// the page. robots.txt is loaded on the first call, if it can't be
+// loaded every page is allowed.
+func (f *Fetcher) checkRobots(ctx context.Context, page string) {
+	u, err := url.Parse(page)
+	if err != nil {
+		return
+	}
+
+	f.robotsOnce.Do(func() {
+		f.disallowed = f.loadRobots(ctx, u.Scheme+"://"+u.Host+"/robots.txt")
+	})
+
+	for _, rule := range f.disallowed {
+		if !rule.MatchString(u.EscapedPath()) {
+			continue
+		}
+		f.mu.Lock()
+		warn := !f.warned[rule.String()]
+		if f.warned == nil {
+			f.warned = make(map[string]bool)
+		}
+		f.warned[rule.String()] = true
+		f.mu.Unlock()
+		if warn {
+			f.Log.Warnf("robots.txt disallows pages like %s\n", u.Path)
+		}
+		return
+	}
+}
+
+// loadRobots fetches a robots.txt and returns its rules for all agents
+func (f *Fetcher) loadRobots(ctx context.Context, robotsURL string) []*regexp.Regexp {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, robotsURL, nil)
+	if err != nil {
+		return nil
+	}
+	if f.UserAgent != "" {
+		req.Header.Set("User-Agent", f.UserAgent)
+	}
+	resp, err := (&http.Client{Timeout: f.Timeout}).Do(req)
+	if err != nil {
+		return nil
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil
+	}
+	return parseRobots(resp.Body)
+}
+
+// parseRobots returns the Disallow rules of the "User-agent: *" groups
+// of a robots.txt as patterns for the path. "*" matches anything and a
+// trailing "$" anchors the end, Allow rules are ignored.
+func parseRobots(r io.Reader) []*regexp.Regexp {
+	var rules []*regexp.Regexp
+	applies, inRules := false, false
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		key, value, found := strings.Cut(line, ":")
+		if !found {
+			continue
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		value = strings.TrimSpace(value)
+
+		switch key {
+		case "user-agent":
+			// A User-agent line after rules starts a new group
+			if inRules {
+				applies, inRules = false, false
+			}
+			if value == "*" {
+				applies = true
+			}
+		case "disallow", "allow":
+			inRules = true
+			if key == "allow" || !applies || value == "" {
+				continue
+			}
+			pattern := regexp.QuoteMeta(strings.TrimSuffix(value, "$"))
+			pattern = "^" + strings.ReplaceAll(pattern, `\*`, ".*")
+			if strings.HasSuffix(value, "$") {
+				pattern += "$"
+			}
+			if rule, err := regexp.Compile(pattern); err == nil {
+				rules = append(rules, rule)
+			}
+		}
+	}
+	return rules
+}
+
+// sleep waits for the given duration or until ctx is done
+func sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// backoff returns the delay before the next attempt: the retry delay
+// doubled for every failed attempt, capped at the maximum delay and
+// with up to 20% random jitter so parallel workers don't retry in sync
+func (f *Fetcher) backoff(retry int) time.Duration {
+	delay := f.MaxDelay
+	if retry < 32 && f.RetryDelay<<retry > 0 && f.RetryDelay<<retry < f.MaxDelay {
+		delay = f.RetryDelay << retry
+	}
+	if delay <= 0 {
+		return 0
+	}
+	return delay + time.Duration(rand.Int63n(int64(delay)/5+1))
+}
+
+// retryAfter parses a Retry-After header given in seconds or as a date
+func retryAfter(header string) (time.Duration, bool) {
+	if header == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(header); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if date, err := http.ParseTime(header); err == nil {
+		return max(time.Until(date), 0), true
+	}
+	return 0, false
+}
+
+// validUsername matches the characters a Letterboxd username may contain
+var validUsername = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// Reasons CheckUser rejects a user besides errNotFound and errGated
+var (
+	errInvalidUser = errors.New("the username has characters Letterboxd doesn't allow")
+	errPrivate     = errors.New("the profile is private")
+)
+
+// CheckUser verifies if a Letterboxd username exists and its ratings can
+// be collected. If not, the error tells why: errInvalidUser, errNotFound,
+// errGated or errPrivate, any other error is a network failure and the
+// user may well exist.
+func CheckUser(ctx context.Context, username string) (bool, error) {
+	// Check if username contains only characters Letterboxd allows
+	if !validUsername.MatchString(username) {
+		return false, errInvalidUser
+	}
+
+	// Check if the user exists on Letterboxd, deactivated accounts are
+	// gone as well
+	url := DefaultFetcher.URL("/" + username)
+	doc, err := DefaultFetcher.Get(ctx, url)
+	if err != nil {
+		return false, err
+	}
+
+	// Check if the page has the expected structure
+	header := doc.Find("body header section")
+	if header.Length() == 0 {
+		return false, errNotFound
+	}
+
+	if isPrivate(doc) {
+		return false, errPrivate
+	}
+
+	return true, nil
+}
+
+// UserMessage describes why CheckUser rejected a user
+func UserMessage(username string, err error) string {
+	switch {
+	case errors.Is(err, errInvalidUser):
+		return fmt.Sprintf("The user \"%s\" does not exist.", username)
+	case errors.Is(err, errNotFound):
+		return fmt.Sprintf("The user \"%s\" does not exist or no longer exists.", username)
+	case errors.Is(err, errGated):
+		return fmt.Sprintf("The profile of \"%s\" requires signing in, it is skipped.", username)
+	case errors.Is(err, errPrivate):
+		return fmt.Sprintf("The profile of \"%s\" is private, no ratings can be collected.", username)
+	}
+	return fmt.Sprintf("The user \"%s\" could not be checked: %v.", username, err)
+}
+
+// isPrivate reports if a profile page is locked for visitors
+func isPrivate(doc *goquery.Document) bool {
+	text := strings.ToLower(doc.Find("body").Text())
+	return strings.Contains(text, "profile is private") || doc.Find(".private-profile, .profile-private").Length() > 0
+}
+
+// findFollowing gets all users the given user is following. If a page
+// fails to load the users found so far are returned with the error.
+func findFollowing(ctx context.Context, user string) ([]string, error) {
+	return findUsers(ctx, user, "following")
+}
+
+// findFollowers gets all users following the given user, like findFollowing
+func findFollowers(ctx context.Context, user string) ([]string, error) {
+	return findUsers(ctx, user, "followers")
+}
+
+// findUsers gets all users on the given list ("following" or "followers")
+// of a user
+func findUsers(ctx context.Context, user string, list string) ([]string, error) {
+	users := []string{}
+	seen := make(map[string]bool)
+	url := DefaultFetcher.URL("/" + user + "/" + list + "/")
+	visited := make(map[string]bool)
+
+	for page := 1; ; page++ {
+		doc, err := DefaultFetcher.Get(ctx, url)
+		if err != nil {
+			return users, fmt.Errorf("page %d of the %s list: %w", page, list, err)
+		}
+
+		doc.Find("td.table-person").Each(func(_ int, s *goquery.Selection) {
+			if href, exists := s.Find("h3 a").Attr("href"); exists {
+				userURL := strings.Trim(href, "/")
+				if !seen[userURL] {
+					seen[userURL] = true
+					users = append(users, userURL)
+				}
+			}
+		})
+
+		next, ok := nextPage(doc, visited, page, url, maxPages)
+		if !ok {
+			return users, nil
+		}
+		url = next
+	}
+}
+
+// maxPages caps a paged list whose length isn't known, far beyond the
+// longest real one
+const maxPages = 10000
+
+// pageSlack is how many pages a list may have beyond the ones its known
+// length needs, as entries are added while it is paged
+const pageSlack = 5
+
+// pageLimit returns the most pages followed of a list with count entries,
+// perPage on every page, or maxPages if count isn't known
+func pageLimit(count int, perPage int) int {
+	if count <= 0 {
+		return maxPages
+	}
+	return (count+perPage-1)/perPage + pageSlack
+}
+
+// nextPage returns the URL of the page after doc, which was loaded from
+// url as the given page number, or false on the last page. A link back to
+// a page that was already loaded, or paging past limit, ends the list
+// with a warning instead of looping forever.
+func nextPage(doc *goquery.Document, visited map[string]bool, page int, url string, limit int) (string, bool) {
+	visited[url] = true
+	nextLink, exists := doc.Find("div.pagination a.next").Attr("href")
+	if !exists {
+		return "", false
+	}
+
+	next := DefaultFetcher.URL(nextLink)
+	if visited[next] {
+		Log.Warnf("Page %d of %s links back to an earlier page, the following pages are skipped.\n", page, url)
+		return "", false
+	}
+	if page >= limit {
+		Log.Warnf("%s has more than %d pages, the following pages are skipped.\n", url, limit)
+		return "", false
+	}
+	return next, true
+}
+
+// Networks maps the names accepted by -network to their description
+var Networks = map[string]string{
+	"following": "the users you follow",
+	"followers": "your followers",
+	"mutuals":   "the users you follow who follow you back",
+	"union":     "the users you follow and your followers",
+}
+
+// findFriends gets the friends of a user from the given network
+func findFriends(ctx context.Context, user string, network string) ([]string, error) {
+	if network == "following" {
+		return findFollowing(ctx, user)
+	}
+
+	followers, err := findFollowers(ctx, user)
+	if err != nil || network == "followers" {
+		return followers, err
+	}
+	following, err := findFollowing(ctx, user)
+	if err != nil {
+		return following, err
+	}
+
+	if network == "union" {
+		return Dedupe(append(following, followers...)), nil
+	}
+
+	isFollower := make(map[string]bool)
+	for _, u := range followers {
+		isFollower[u] = true
+	}
+	var mutuals []string
+	for _, u := range following {
+		if isFollower[u] {
+			mutuals = append(mutuals, u)
+		}
+	}
+	return mutuals, nil
+}
+
+// FindNetworks gets the friends of several users from the given network,
+// every friend once
+func FindNetworks(ctx context.Context, users []string, network string) ([]string, error) {
+	var friends []string
+	for _, user := range users {
+		found, err := findFriends(ctx, user, network)
+		friends = append(friends, found...)
+		if err != nil {
+			return Dedupe(friends), err
+		}
+	}
+	return Dedupe(friends), nil
+}
+
+// MaxNetwork caps the number of friends after adding the friends of
+// friends, every one of them costs at least two requests
+const MaxNetwork = 500
+
+// ExpandFriends adds the users every friend follows to the friends,
+// without the user themselves. The following lists are fetched in
+// parallel, incomplete lists are used as far as they were loaded.
+func ExpandFriends(ctx context.Context, users []string, friends []string) []string {
+	Log.Infof("\nThe friends of %d friends are searched...\n", len(friends))
+
+	var wg sync.WaitGroup
+	following := make([][]string, len(friends))
+	semaphore := make(chan struct{}, numWorkers(len(friends)))
+	for i, friend := range friends {
+		wg.Add(1)
+		go func(i int, friend string) {
+			defer wg.Done()
+
+			select {
+			case semaphore <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			defer func() { <-semaphore }()
+
+			users, err := findFollowing(ctx, friend)
+			if err != nil {
+				Log.Warnf("The users \"%s\" follows may be incomplete: %v\n", friend, err)
+			}
+			// Every goroutine writes only its own index
+			following[i] = users
+		}(i, friend)
+	}
+	wg.Wait()
+
+	network := append([]string{}, friends...)
+	for _, found := range following {
+		network = append(network, found...)
+	}
+	network = Dedupe(WithoutUsers(network, users...))
+
+	if len(network) > MaxNetwork {
+		Log.Warnf("%d users were found, only the first %d are used.\n", len(network), MaxNetwork)
+		network = network[:MaxNetwork]
+	}
+	Log.Infof("%d users were found\n", len(network))
+	return network
+}
+
+// Dedupe removes repeated usernames, keeping the first occurrence.
+// Letterboxd usernames are case-insensitive.
+func Dedupe(users []string) []string {
+	seen := make(map[string]bool)
+	var unique []string
+	for _, user := range users {
+		key := strings.ToLower(user)
+		if !seen[key] {
+			seen[key] = true
+			unique = append(unique, user)
+		}
+	}
+	return unique
+}
+
+// WithoutUsers drops the given users from the friends, your own ratings
+// aren't your friends' ratings
+func WithoutUsers(friends []string, users ...string) []string {
+	isUser := make(map[string]bool)
+	for _, user := range users {
+		isUser[strings.ToLower(user)] = true
+	}
+
+	var others []string
+	for _, friend := range friends {
+		if isUser[strings.ToLower(friend)] {
+			Log.Infof("\"%s\" is you, so it isn't used as a friend.\n", friend)
+			continue
+		}
+		others = append(others, friend)
+	}
+	return others
+}
+
+// CheckFriends returns the given users that exist on Letterboxd
+func CheckFriends(ctx context.Context, users []string) []string {
+	var friends []string
+	for _, friend := range users {
+		if ok, err := CheckUser(ctx, friend); ok {
+			friends = append(friends, friend)
+		} else {
+			Log.Errorf("%s\n", UserMessage(friend, err))
+		}
+	}
+	return friends
+}
+
+// getMovieCount gets the number of rated movies for each friend in
+// parallel. movieCount[i] and errs[i] belong to friends[i], errs[i] is
+// set if the number couldn't be loaded.
+func getMovieCount(ctx context.Context, friends []string) (movieCount []int, errs []error) {
+	Log.Infof("\nThe number of rated movies is collected...\n")
+	movieCount = make([]int, len(friends))
+	errs = make([]error, len(friends))
+
+	var wg sync.WaitGroup
+	semaphore := make(chan struct{}, numWorkers(len(friends)))
+
+	for i, friend := range friends {
+		wg.Add(1)
+		go func(i int, username string) {
+			defer wg.Done()
+
+			select {
+			case semaphore <- struct{}{}:
+			case <-ctx.Done():
+				errs[i] = ctx.Err()
+				return
+			}
+			defer func() { <-semaphore }()
+
+			// Every goroutine writes only its own index
+			movieCount[i], errs[i] = countRatedMovies(ctx, username)
+		}(i, friend)
+	}
+	wg.Wait()
+
+	return movieCount, errs
+}
+
+// countRatedMovies gets the number of rated movies of a user
+func countRatedMovies(ctx context.Context, username string) (int, error) {
+	url := DefaultFetcher.URL("/" + username + "/films/rated/.5-5/")
+	doc, err := DefaultFetcher.Get(ctx, url)
+	if err != nil {
+		return 0, err
+	}
+
+	// The heading reads "<user> has rated 1,234 films", the number is
+	// read from the text after the user's name, which may contain digits
+	// itself. Without the heading or its number the count is unknown,
+	// which isn't the same as none.
+	name := doc.Find("span.replace-if-you").First()
+	if name.Length() == 0 {
+		return 0, errNoCount
+	}
+	count, ok := parseCount(textAfter(name))
+	if !ok {
+		return 0, errNoCount
+	}
+	return count, nil
+}
+
+// textAfter returns the text that follows an element within its parent
+func textAfter(s *goquery.Selection) string {
+	var text strings.Builder
+	after := false
+	s.Parent().Contents().Each(func(_ int, node *goquery.Selection) {
+		if after {
+			text.WriteString(node.Text())
+		}
+		if node.Get(0) == s.Get(0) {
+			after = true
+		}
+	})
+	return text.String()
+}
+
+// errNoCount is returned if the number of rated films isn't on the page
+var errNoCount = errors.New("the number of rated films could not be read")
+
+// countNumber matches a number with optional thousands separators,
+// e.g. "12,345", "12.345" or "12 345"
+var countNumber = regexp.MustCompile(`\d{1,3}(?:[,.\s\x{a0}]\d{3})+|\d+`)
+
+// parseCount returns the first number in a text, false if there is none
+func parseCount(text string) (int, bool) {
+	match := countNumber.FindString(text)
+	var digits strings.Builder
+	for _, char := range match {
+		if char >= '0' && char <= '9' {
+			digits.WriteRune(char)
+		}
+	}
+	count, err := strconv.Atoi(digits.String())
+	return count, err == nil
+}
+
+// moviesPerPage is the number of movies on one page of a film list
+const moviesPerPage = 72
+
+// FriendsPerPage is the number of users on one page of a following list
+const FriendsPerPage = 25
+
+// RatedPages estimates the pages needed to collect a friend's ratings
+func RatedPages(count int) int {
+	return max(1, (count+moviesPerPage-1)/moviesPerPage)
+}
+
+// TotalPages estimates the pages needed to collect all ratings
+func TotalPages(movieCount []int) int {
+	total := 0
+	for _, count := range movieCount {
+		total += RatedPages(count)
+	}
+	return total
+}
+
+// getAllMovies gets all movies watched by a user. The first page tells
+// the number of pages, the others are then fetched in parallel. If a
+// page can't be loaded, the movies are returned with an error as they
+// are incomplete.
+func getAllMovies(ctx context.Context, username string) ([]string, error) {
+	Log.Infof("All of '%s's' movies are searched...\n\n", username)
+
+	url := DefaultFetcher.URL("/" + username + "/films/")
+	doc, err := DefaultFetcher.Get(ctx, url)
+	if err != nil {
+		return nil, fmt.Errorf("page 1: %w", err)
+	}
+
+	total := lastPage(doc)
+	pages := make([][]string, total)
+	pages[0] = posterLinks(doc)
+
+	// Show the loaded pages on one line
+	var mu sync.Mutex
+	var pageErr error
+	done := 1
+	Log.Infof("\r%d/%d pages loaded", done, total)
+	pageDone := func() {
+		mu.Lock()
+		defer mu.Unlock()
+		done++
+		Log.Infof("\r%d/%d pages loaded", done, total)
+	}
+
+	var wg sync.WaitGroup
+	semaphore := make(chan struct{}, numWorkers(total-1))
+	for page := 2; page <= total; page++ {
+		wg.Add(1)
+		go func(page int) {
+			defer wg.Done()
+
+			select {
+			case semaphore <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			defer func() { <-semaphore }()
+			defer pageDone()
+
+			doc, err := DefaultFetcher.Get(ctx, url+"page/"+strconv.Itoa(page)+"/")
+			if err != nil {
+				mu.Lock()
+				if pageErr == nil {
+					pageErr = fmt.Errorf("page %d: %w", page, err)
+				}
+				mu.Unlock()
+				return
+			}
+			// Every goroutine writes only its own page
+			pages[page-1] = posterLinks(doc)
+		}(page)
+	}
+	wg.Wait()
+	Log.Infof("\n")
+	if pageErr == nil {
+		pageErr = ctx.Err()
+	}
+
+	var movies []string
+	for _, links := range pages {
+		movies = append(movies, links...)
+	}
+
+	Log.Infof("\"%s\" is finished.\n", username)
+	Log.Infof("%d movies were found\n\n", len(movies))
+	return movies, pageErr
+}
+
+// posterLinks returns the links of all movie posters on a page
+func posterLinks(doc *goquery.Document) []string {
+	var links []string
+	doc.Find("li.poster-container").Each(func(_ int, s *goquery.Selection) {
+		if link, exists := s.Find("div").Attr("data-target-link"); exists {
+			links = append(links, link)
+		}
+	})
+	return links
+}
+
+// lastPage returns the number of pages of a paginated list
+func lastPage(doc *goquery.Document) int {
+	last := 1
+	doc.Find("div.paginate-pages li.paginate-page").Each(func(_ int, s *goquery.Selection) {
+		if nr, err := strconv.Atoi(strings.TrimSpace(s.Text())); err == nil && nr > last {
+			last = nr
+		}
+	})
+	return last
+}
+
+// getRatedMovies gets all rated movies by a user, excluding specified
+// movies. If includeMovies isn't empty, only those movies are collected
+// and paging stops once all of them are found. If a page can't be loaded,
+// the movies found so far are returned with an error telling that they
+// are incomplete. The paging stops a few pages after count rated movies,
+// the number of ratings on the user's profile, unless it is 0 for unknown.
+// With maxMovies > 0 the ratings are paged in the order
+// they were given, newest first, and it stops after that many movies, the
+// user's most recently rated ones. onPage, if not nil, is called after
+// every loaded page.
+func getRatedMovies(ctx context.Context, username string, count int, excludeMovies []string, includeMovies []string, maxMovies int, onPage func()) ([]Movie, error) {
+	var movies []Movie
+
+	excludeMap := make(map[string]bool)
+	for _, m := range excludeMovies {
+		excludeMap[m] = true
+	}
+	includeMap := make(map[string]bool)
+	for _, m := range includeMovies {
+		if !excludeMap[m] {
+			includeMap[m] = true
+		}
+	}
+
+	url := DefaultFetcher.URL("/" + username + "/films/by/member-rating/")
+	if maxMovies > 0 {
+		url = DefaultFetcher.URL("/" + username + "/films/by/rated-date/")
+	}
+	visited := make(map[string]bool)
+	for page := 1; ; page++ {
+		doc, err := DefaultFetcher.Get(ctx, url)
+		if err != nil {
+			return movies, fmt.Errorf("page %d: %w", page, err)
+		}
+		if onPage != nil {
+			onPage()
+		}
+
+		moviesOnPage := false
+		doc.Find("li.poster-container").Each(func(_ int, s *goquery.Selection) {
+			poster := s.Find("div")
+			newTitle, exists := poster.Attr("data-target-link")
+			if !exists {
+				return
+			}
+
+			ratingElem := s.Find("p span.rating")
+			if ratingElem.Length() == 0 {
+				Log.Debugf("%s: no rating for %s\n", username, newTitle)
+				return
+			}
+
+			moviesOnPage = true
+			rating, ok := parseRating(ratingElem)
+			if !ok {
+				class, _ := ratingElem.Attr("class")
+				Log.Debugf("%s: unknown rating \"%s\" for %s\n", username, class, newTitle)
+				return
+			}
+
+			if excludeMap[newTitle] || (len(includeMovies) > 0 && !includeMap[newTitle]) {
+				return
+			}
+			movies = append(movies, Movie{URL: newTitle, Rating: rating, User: username, FilmID: poster.AttrOr("data-film-id", "")})
+		})
+
+		if !moviesOnPage {
+			return movies, nil
+		}
+		if len(includeMovies) > 0 && len(movies) == len(includeMap) {
+			return movies, nil
+		}
+		if maxMovies > 0 && len(movies) >= maxMovies {
+			return movies[:maxMovies], nil
+		}
+
+		next, ok := nextPage(doc, visited, page, url, pageLimit(count, moviesPerPage))
+		if !ok {
+			return movies, nil
+		}
+		url = next
+	}
+}
+
+// parseRating reads the rating on the 1-10 scale from the "rated-N"
+// class of a rating element, wherever it is among the classes
+func parseRating(ratingElem *goquery.Selection) (int, bool) {
+	ratingClass, exists := ratingElem.Attr("class")
+	if !exists {
+		return 0, false
+	}
+
+	for _, class := range strings.Fields(ratingClass) {
+		ratingStr, found := strings.CutPrefix(class, "rated-")
+		if !found {
+			continue
+		}
+		if rating, err := strconv.Atoi(ratingStr); err == nil && rating >= 1 && rating <= 10 {
+			return rating, true
+		}
+	}
+	return 0, false
+}
+
+// diaryDay matches the date in the link of a diary entry's day
+var diaryDay = regexp.MustCompile(`/diary/for/(\d{4}/\d{2}/\d{2})/`)
+
+// getDiaryMovies gets the rated entries of a user's diary, newest first,
+// excluding specified movies and, like getRatedMovies, only collecting
+// includeMovies if that isn't empty. A movie logged more than once counts with
+// its latest entry. Paging stops at the first entry before since, as
+// the diary is sorted by date. Like getRatedMovies it returns the movies
+// found so far with an error if a page can't be loaded, and stops after
+// maxMovies movies if maxMovies > 0, and calls onPage if it isn't nil.
+func getDiaryMovies(ctx context.Context, username string, excludeMovies []string, includeMovies []string, maxMovies int, since time.Time, onPage func()) ([]Movie, error) {
+	var movies []Movie
+
+	seen := make(map[string]bool)
+	for _, m := range excludeMovies {
+		seen[m] = true
+	}
+	includeMap := make(map[string]bool)
+	for _, m := range includeMovies {
+		if !seen[m] {
+			includeMap[m] = true
+		}
+	}
+
+	url := DefaultFetcher.URL("/" + username + "/films/diary/")
+	visited := make(map[string]bool)
+	for page := 1; ; page++ {
+		doc, err := DefaultFetcher.Get(ctx, url)
+		if err != nil {
+			return movies, fmt.Errorf("diary page %d: %w", page, err)
+		}
+		if onPage != nil {
+			onPage()
+		}
+
+		entries, older := 0, false
+		doc.Find("tr.diary-entry-row").Each(func(_ int, s *goquery.Selection) {
+			entries++
+
+			href, _ := s.Find("td.td-day a").Attr("href")
+			day := diaryDay.FindStringSubmatch(href)
+			if day == nil {
+				return
+			}
+			watched, err := time.Parse("2006/01/02", day[1])
+			if err != nil {
+				return
+			}
+			if !since.IsZero() && watched.Before(since) {
+				older = true
+				return
+			}
+
+			link := diaryFilmLink(s)
+			rating, ok := parseRating(s.Find("td.td-rating span.rating"))
+			if link == "" || !ok || seen[link] || (len(includeMovies) > 0 && !includeMap[link]) {
+				return
+			}
+			seen[link] = true
+			filmID := s.Find("td.td-actions").AttrOr("data-film-id", "")
+			movies = append(movies, Movie{URL: link, Rating: rating, User: username, Watched: watched, FilmID: filmID})
+		})
+
+		if entries == 0 || older || (len(includeMovies) > 0 && len(movies) == len(includeMap)) {
+			return movies, nil
+		}
+		if maxMovies > 0 && len(movies) >= maxMovies {
+			return movies[:maxMovies], nil
+		}
+
+		next, ok := nextPage(doc, visited, page, url, maxPages)
+		if !ok {
+			return movies, nil
+		}
+		url = next
+	}
+}
+
+// diaryFilmLink returns the /film/<slug>/ link of a diary entry
+func diaryFilmLink(s *goquery.Selection) string {
+	if link, exists := s.Find("td.td-actions").Attr("data-film-link"); exists {
+		return link
+	}
+	// The title links to the user's review, /<user>/film/<slug>/
+	href, _ := s.Find("h3 a").Attr("href")
+	if i := strings.Index(href, "/film/"); i >= 0 {
+		return href[i:]
+	}
+	return ""
+}
+
+// filterWatched keeps the movies watched between since and until, both
+// inclusive. A zero time leaves that side of the window open.
+func filterWatched(movies []Movie, since time.Time, until time.Time) []Movie {
+	var filtered []Movie
+	for _, m := range movies {
+		if !since.IsZero() && m.Watched.Before(since) {
+			continue
+		}
+		if !until.IsZero() && m.Watched.After(until) {
+			continue
+		}
+		filtered = append(filtered, m)
+	}
+	return filtered
+}
+
+// sameFilmLinks gives the ratings of a film collected under different
+// links, e.g. an old slug on a cached page and the current one, the same
+// link. Ratings with the same film id are the same film, they get the link
+// most of them use, the first one alphabetically on a tie.
+func sameFilmLinks(movies []Movie) {
+	counts := make(map[string]map[string]int)
+	for _, m := range movies {
+		if m.FilmID == "" {
+			continue
+		}
+		if counts[m.FilmID] == nil {
+			counts[m.FilmID] = make(map[string]int)
+		}
+		counts[m.FilmID][m.URL]++
+	}
+
+	links := make(map[string]string)
+	for id, urls := range counts {
+		if len(urls) < 2 {
+			continue
+		}
+		best := ""
+		for url, n := range urls {
+			if best == "" || n > urls[best] || (n == urls[best] && url < best) {
+				best = url
+			}
+		}
+		links[id] = best
+	}
+	for i := range movies {
+		if link, ok := links[movies[i].FilmID]; ok {
+			movies[i].URL = link
+		}
+	}
+}
+
+// mergeMovies combines all movie ratings from different users
+func mergeMovies(movies []Movie) []MovieWithRatings {
+	// Group the ratings by movie instead of sorting all of them, only the
+	// unique movies are sorted
+	groups := make(map[string][]int)
+	for i, m := range movies {
+		groups[m.URL] = append(groups[m.URL], i)
+	}
+
+	uniqueMovies := make([]MovieWithRatings, 0, len(groups))
+	for url, indices := range groups {
+		// Sort by user so the ratings of a movie are in the same order on
+		// every run
+		sort.Slice(indices, func(i, j int) bool {
+			return movies[indices[i]].User < movies[indices[j]].User
+		})
+
+		ratings := make([]int, len(indices))
+		users := make([]string, len(indices))
+		for k, i := range indices {
+			ratings[k] = movies[i].Rating
+			users[k] = movies[i].User
+		}
+		uniqueMovies = append(uniqueMovies, MovieWithRatings{
+			URL:     url,
+			Ratings: ratings,
+			Users:   users,
+		})
+	}
+
+	sort.Slice(uniqueMovies, func(i, j int) bool {
+		return uniqueMovies[i].URL < uniqueMovies[j].URL
+	})
+	return uniqueMovies
+}
+
+// FilterRatings drops every rating below minRating (on the 1-10 scale)
+// and the movies left without ratings
+func FilterRatings(uniqueMovies []MovieWithRatings, minRating int) []MovieWithRatings {
+	if minRating <= 1 {
+		return uniqueMovies
+	}
+
+	var filtered []MovieWithRatings
+	for _, movie := range uniqueMovies {
+		kept := MovieWithRatings{URL: movie.URL}
+		for i, r := range movie.Ratings {
+			if r < minRating {
+				continue
+			}
+			kept.Ratings = append(kept.Ratings, r)
+			if i < len(movie.Users) {
+				kept.Users = append(kept.Users, movie.Users[i])
+			}
+		}
+		if len(kept.Ratings) > 0 {
+			filtered = append(filtered, kept)
+		}
+	}
+	return filtered
+}
+
+// ProcessResults processes the merged movies data. movieCounts holds
+// the number of rated films of every friend for the count-weighted
+// average, minVotes is the prior of the Bayesian average and sims the
+// friends' similarity for the similarity-weighted average.
+func ProcessResults(uniqueMovies []MovieWithRatings, movieCounts map[string]int, minVotes float64, sims map[string]FriendSimilarity) []Result {
+	var results []Result
+
+	for _, movie := range uniqueMovies {
+		avgRating := avg(movie.Ratings)
+		results = append(results, Result{
+			AvgRating:      avgRating,
+			Median:         median(movie.Ratings),
+			Mode:           mode(movie.Ratings),
+			WeightedRating: weighted(movie.Ratings),
+			RMSRating:      leastSquare(movie.Ratings),
+			WeightedAvg:    countWeightedAvg(movie.Ratings, movie.Users, movieCounts),
+			Controversy:    stdDev(movie.Ratings),
+			SimilarAvg:     similarityWeightedAvg(movie.Ratings, movie.Users, sims),
+			LovedBy:        lovedBy(movie.Ratings),
+			VoteCount:      len(movie.Ratings),
+			URL:            movie.URL,
+			Ratings:        movie.Ratings,
+			Raters:         movie.Users,
+		})
+	}
+
+	mean := globalMean(uniqueMovies)
+	for i := range results {
+		results[i].GemScore = bayesian(results[i].AvgRating, results[i].VoteCount, gemPrior, mean)
+		results[i].BayesianRating = bayesian(results[i].AvgRating, results[i].VoteCount, minVotes, mean)
+	}
+
+	return results
+}
+
+// globalMean returns the mean of all collected ratings
+func globalMean(uniqueMovies []MovieWithRatings) float64 {
+	sum, count := 0, 0
+	for _, movie := range uniqueMovies {
+		for _, r := range movie.Ratings {
+			sum += r
+			count++
+		}
+	}
+	if count == 0 {
+		return 0
+	}
+	return float64(sum) / float64(count)
+}
+
+// Meta holds the details of a movie scraped from its page
+type Meta struct {
+	Title   string
+	Year    int
+	Genres  []string
+	Runtime int // in minutes, 0 if unknown
+	TMDBID  int // The Movie Database id, 0 if unknown
+	Ratings int // number of ratings on all of Letterboxd
+	// Canonical is the /film/<slug>/ path the page names as its own, which
+	// differs from the fetched one for old slugs that redirect
+	Canonical string
+	TMDBType  string // "movie" or "tv", TMDB ids are only unique per type
+}
+
+// metaCache holds the details of every movie fetched so far, guarded by
+// metaMu as movies are enriched in parallel
+var (
+	metaCache = make(map[string]Meta)
+	metaMu    sync.Mutex
+)
+
+// LoadMetaCache fills metaCache from a file written by SaveMetaCache. A
+// missing file is an empty cache.
+func LoadMetaCache(filename string) error {
+	file, err := os.Open(filename)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var cached map[string]Meta
+	if err := json.NewDecoder(file).Decode(&cached); err != nil {
+		return err
+	}
+	metaMu.Lock()
+	defer metaMu.Unlock()
+	for url, meta := range cached {
+		metaCache[url] = meta
+	}
+	return nil
+}
+
+// SaveMetaCache writes metaCache to a file, through a temporary file so
+// an interrupted write keeps the previous cache
+func SaveMetaCache(filename string) error {
+	metaMu.Lock()
+	data, err := json.Marshal(metaCache)
+	metaMu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	tmp := filename + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filename)
+}
+
+// ogTitle matches the "Title (Year)" form of a film page's og:title
+var ogTitle = regexp.MustCompile(`^(.*) \((\d{4})\)$`)
+
+// runtimeText matches the runtime in a film page's footer
+var runtimeText = regexp.MustCompile(`(\d+)\s*mins?\b`)
+
+// ratingCount matches the number of ratings in a film page's structured
+// data, which Letterboxd leaves out for films with very few ratings
+var ratingCount = regexp.MustCompile(`"ratingCount"\s*:\s*(\d+)`)
+
+// FetchMeta gets the title and year of a movie from its page
+func FetchMeta(ctx context.Context, url string) (Meta, bool) {
+	metaMu.Lock()
+	meta, ok := metaCache[url]
+	metaMu.Unlock()
+	if ok {
+		return meta, true
+	}
+
+	doc, err := DefaultFetcher.Get(ctx, DefaultFetcher.URL(url))
+	if err != nil || doc == nil {
+		return Meta{}, false
+	}
+
+	content, _ := doc.Find(`meta[property="og:title"]`).Attr("content")
+	if match := ogTitle.FindStringSubmatch(strings.TrimSpace(content)); match != nil {
+		meta.Title = match[1]
+		meta.Year, _ = strconv.Atoi(match[2])
+	} else {
+		meta.Title = strings.TrimSpace(content)
+	}
+
+	// Fall back to the film header
+	if meta.Title == "" {
+		meta.Title = strings.TrimSpace(doc.Find("section.film-header-group h1 span.name").First().Text())
+	}
+	if meta.Year == 0 {
+		year := doc.Find("section.film-header-group .releaseyear a, section.film-header-group .releasedate a").First().Text()
+		meta.Year, _ = strconv.Atoi(strings.TrimSpace(year))
+	}
+
+	doc.Find(`#tab-genres a[href*="/films/genre/"]`).Each(func(_ int, s *goquery.Selection) {
+		meta.Genres = append(meta.Genres, strings.TrimSpace(s.Text()))
+	})
+
+	if match := ratingCount.FindStringSubmatch(doc.Find(`script[type="application/ld+json"]`).Text()); match != nil {
+		meta.Ratings, _ = strconv.Atoi(match[1])
+	}
+
+	tmdbID, _ := doc.Find("body").Attr("data-tmdb-id")
+	meta.TMDBID, _ = strconv.Atoi(tmdbID)
+	meta.TMDBType, _ = doc.Find("body").Attr("data-tmdb-type")
+
+	canonical, _ := doc.Find(`link[rel="canonical"]`).Attr("href")
+	if canonical == "" {
+		canonical, _ = doc.Find(`meta[property="og:url"]`).Attr("content")
+	}
+	if path := strings.TrimPrefix(strings.TrimSpace(canonical), "https://letterboxd.com"); strings.HasPrefix(path, "/film/") {
+		meta.Canonical = path
+	}
+
+	// The footer reads e.g. "117 mins  More at IMDb TMDb"
+	if match := runtimeText.FindStringSubmatch(doc.Find("p.text-footer").First().Text()); match != nil {
+		meta.Runtime, _ = strconv.Atoi(match[1])
+	}
+
+	metaMu.Lock()
+	metaCache[url] = meta
+	if meta.Canonical != "" {
+		metaCache[meta.Canonical] = meta
+	}
+	metaMu.Unlock()
+	return meta, true
+}
+
+// EnrichResults adds the title, year and genres to every result with at
+// least minVotes votes. Every movie page is fetched once, in parallel like
+// the ratings.
+func EnrichResults(ctx context.Context, results []Result, minVotes int) {
+	var urls []string
+	seen := make(map[string]bool)
+	for _, r := range results {
+		if r.VoteCount >= minVotes && !seen[r.URL] {
+			seen[r.URL] = true
+			urls = append(urls, r.URL)
+		}
+	}
+	Log.Infof("The details of %d movies are collected...\n", len(urls))
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	done := 0
+	semaphore := make(chan struct{}, numWorkers(len(urls)))
+
+	Log.Infof("\r%d/%d movies done", done, len(urls))
+	for _, url := range urls {
+		wg.Add(1)
+		go func(url string) {
+			defer wg.Done()
+
+			select {
+			case semaphore <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			defer func() { <-semaphore }()
+
+			FetchMeta(ctx, url)
+
+			mu.Lock()
+			defer mu.Unlock()
+			done++
+			Log.Infof("\r%d/%d movies done", done, len(urls))
+		}(url)
+	}
+	wg.Wait()
+	Log.Infof("\n\n")
+
+	addMeta(results)
+}
+
+// addMeta adds the fetched details to every result whose movie is in
+// metaCache
+func addMeta(results []Result) {
+	metaMu.Lock()
+	defer metaMu.Unlock()
+	for i := range results {
+		if meta, ok := metaCache[results[i].URL]; ok {
+			results[i].Title = meta.Title
+			results[i].Year = meta.Year
+			results[i].Genres = meta.Genres
+			results[i].Runtime = meta.Runtime
+			results[i].TMDBID = meta.TMDBID
+			results[i].TMDBType = meta.TMDBType
+			results[i].GlobalRatings = meta.Ratings
+		}
+	}
+}
+
+// canonicalMovies merges the movies whose fetched pages turned out to be
+// the same film, e.g. an old slug redirecting to the current one, by the
+// canonical path or the TMDB id in metaCache. It returns the merged movies
+// and how many were merged into another one. A friend who rated the film
+// under both slugs keeps their first rating.
+func canonicalMovies(movies []MovieWithRatings) ([]MovieWithRatings, int) {
+	metaMu.Lock()
+	defer metaMu.Unlock()
+
+	groups := make(map[string]int)
+	var merged []MovieWithRatings
+	duplicates := 0
+	for _, movie := range movies {
+		meta := metaCache[movie.URL]
+		url := movie.URL
+		if meta.Canonical != "" {
+			url = meta.Canonical
+		}
+		keys := []string{url}
+		if meta.TMDBID != 0 {
+			keys = append(keys, fmt.Sprintf("tmdb:%s:%d", meta.TMDBType, meta.TMDBID))
+		}
+
+		i, found := -1, false
+		for _, key := range keys {
+			if i, found = groups[key]; found {
+				break
+			}
+		}
+		if !found {
+			i = len(merged)
+			merged = append(merged, MovieWithRatings{URL: url})
+		} else {
+			duplicates++
+		}
+		for _, key := range keys {
+			groups[key] = i
+		}
+
+		// Ratings loaded from older files may lack the users
+		m := &merged[i]
+		for k, rating := range movie.Ratings {
+			user := ""
+			if k < len(movie.Users) {
+				user = movie.Users[k]
+			}
+			if user == "" || !containsUser(m.Users, user) {
+				m.Users = append(m.Users, user)
+				m.Ratings = append(m.Ratings, rating)
+			}
+		}
+	}
+	if duplicates == 0 {
+		return movies, 0
+	}
+
+	// Keep the order mergeMovies gives: ratings by user, movies by URL
+	for i := range merged {
+		m := &merged[i]
+		order := make([]int, len(m.Users))
+		for k := range order {
+			order[k] = k
+		}
+		sort.Slice(order, func(a, b int) bool { return m.Users[order[a]] < m.Users[order[b]] })
+		users := make([]string, len(order))
+		ratings := make([]int, len(order))
+		for k, o := range order {
+			users[k] = m.Users[o]
+			ratings[k] = m.Ratings[o]
+		}
+		m.Users, m.Ratings = users, ratings
+	}
+	sort.Slice(merged, func(i, j int) bool {
+		return merged[i].URL < merged[j].URL
+	})
+	return merged, duplicates
+}
+
+// containsUser reports whether the user is in the list
+func containsUser(users []string, user string) bool {
+	for _, u := range users {
+		if u == user {
+			return true
+		}
+	}
+	return false
+}
+
+// MergeCanonical processes the movies again once their details are
+// fetched if some of them are the same film under different slugs, see
+// canonicalMovies. Otherwise the results are returned unchanged.
+func MergeCanonical(results []Result, movies []MovieWithRatings, movieCounts map[string]int, minVotes float64, sims map[string]FriendSimilarity) []Result {
+	merged, duplicates := canonicalMovies(movies)
+	if duplicates == 0 {
+		return results
+	}
+	Log.Infof("%d movie(s) were listed under an old link as well and are merged.\n\n", duplicates)
+
+	canonical := make(map[string]string)
+	for _, m := range merged {
+		canonical[m.URL] = m.URL
+	}
+	metaMu.Lock()
+	for _, m := range movies {
+		if meta := metaCache[m.URL]; meta.Canonical != "" {
+			canonical[m.URL] = meta.Canonical
+		}
+	}
+	metaMu.Unlock()
+	mine := make(map[string]int)
+	for _, r := range results {
+		if url, ok := canonical[r.URL]; ok && r.MyRating != 0 {
+			mine[url] = r.MyRating
+		}
+	}
+
+	remerged := ProcessResults(merged, movieCounts, minVotes, sims)
+	for i := range remerged {
+		remerged[i].MyRating = mine[remerged[i].URL]
+	}
+	addMeta(remerged)
+	return remerged
+}
+
+// TMDB gets the poster and overview of movies from The Movie Database.
+// Responses are cached in CacheDir by id, as they rarely change and TMDB
+// limits the requests per key.
+type TMDB struct {
+	Key      string
+	BaseURL  string
+	CacheDir string
+	Client   *http.Client
+}
+
+// NewTMDB returns a TMDB client caching in the user's cache directory
+func NewTMDB(key string) *TMDB {
+	t := &TMDB{
+		Key:     key,
+		BaseURL: "https://api.themoviedb.org/3",
+		Client:  &http.Client{Timeout: 10 * time.Second},
+	}
+	if dir, err := os.UserCacheDir(); err == nil {
+		t.CacheDir = filepath.Join(dir, "letterboxd-friends", "tmdb")
+	}
+	return t
+}
+
+// TMDBMovie holds the fields of a TMDB movie or TV show that are used,
+// the path of its poster and its overview
+type TMDBMovie struct {
+	PosterPath string `json:"poster_path"`
+	Overview   string `json:"overview"`
+}
+
+// tmdbPosterURL is prefixed to a poster path for a small poster
+const tmdbPosterURL = "https://image.tmdb.org/t/p/w154"
+
+// Movie gets a movie by its TMDB id, from the cache if possible. Ids are
+// only unique per kind, so a kind of "tv" is looked up among the TV shows
+// and anything else among the movies.
+func (t *TMDB) Movie(ctx context.Context, kind string, id int) (TMDBMovie, error) {
+	var movie TMDBMovie
+	path, file := "movie", strconv.Itoa(id)+".json"
+	if kind == "tv" {
+		path, file = "tv", "tv-"+file
+	}
+	cachePath := filepath.Join(t.CacheDir, file)
+	if t.CacheDir != "" {
+		if data, err := os.ReadFile(cachePath); err == nil && json.Unmarshal(data, &movie) == nil {
+			return movie, nil
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s/%s/%d?api_key=%s", t.BaseURL, path, id, url.QueryEscape(t.Key)), nil)
+	if err != nil {
+		return movie, err
+	}
+	resp, err := t.Client.Do(req)
+	if err != nil {
+		return movie, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return movie, fmt.Errorf("TMDB answered %s", resp.Status)
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return movie, err
+	}
+	if err := json.Unmarshal(data, &movie); err != nil {
+		return movie, err
+	}
+
+	// A failed write only costs a refetch
+	if t.CacheDir != "" && os.MkdirAll(t.CacheDir, 0o755) == nil {
+		os.WriteFile(cachePath, data, 0o644)
+	}
+	return movie, nil
+}
+
+// tmdbKey identifies an entry of TMDB, whose ids are only unique per type
+type tmdbKey struct {
+	kind string
+	id   int
+}
+
+// AddTMDB adds the poster and overview to every result with a known TMDB
+// id, movies that fail keep their plain title
+func AddTMDB(ctx context.Context, results []Result, t *TMDB) {
+	var ids []tmdbKey
+	seen := make(map[tmdbKey]bool)
+	for _, r := range results {
+		key := tmdbKey{r.TMDBType, r.TMDBID}
+		if r.TMDBID > 0 && !seen[key] {
+			seen[key] = true
+			ids = append(ids, key)
+		}
+	}
+	Log.Infof("The posters of %d movies are collected from TMDB...\n", len(ids))
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	movies := make(map[tmdbKey]TMDBMovie)
+	var failed int
+	semaphore := make(chan struct{}, numWorkers(len(ids)))
+
+	for _, id := range ids {
+		wg.Add(1)
+		go func(id tmdbKey) {
+			defer wg.Done()
+
+			select {
+			case semaphore <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			defer func() { <-semaphore }()
+
+			movie, err := t.Movie(ctx, id.kind, id.id)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				Log.Debugf("TMDB %s %d: %v\n", id.kind, id.id, err)
+				failed++
+				return
+			}
+			movies[id] = movie
+		}(id)
+	}
+	wg.Wait()
+	if failed > 0 {
+		Log.Warnf("The TMDB details of %d movie(s) could not be loaded.\n", failed)
+	}
+
+	for i := range results {
+		if movie, ok := movies[tmdbKey{results[i].TMDBType, results[i].TMDBID}]; ok {
+			if movie.PosterPath != "" {
+				results[i].Poster = tmdbPosterURL + movie.PosterPath
+			}
+			results[i].Overview = movie.Overview
+		}
+	}
+}
+
+// SortResults ranks the results by the given metric, the average rating
+// if it is unknown
+func SortResults(results []Result, metric string) {
+	by, ok := comparators[metric]
+	if !ok {
+		by = byAvg
+	}
+	sort.Slice(results, by(results))
+}
+
+// GetListMovies gets the /film/<slug>/ links of all movies on a
+// Letterboxd list. Both the full URL and "<user>/list/<name>" are
+// accepted.
+func GetListMovies(ctx context.Context, list string) ([]string, error) {
+	path := strings.TrimPrefix(strings.TrimPrefix(list, "https://"), "http://")
+	path = strings.Trim(strings.TrimPrefix(path, "letterboxd.com"), "/")
+	if !strings.Contains(path, "/list/") {
+		return nil, fmt.Errorf("\"%s\" is no list URL", list)
+	}
+
+	var movies []string
+	url := DefaultFetcher.URL("/" + path + "/")
+	visited := make(map[string]bool)
+	for page := 1; ; page++ {
+		doc, err := DefaultFetcher.Get(ctx, url)
+		if err != nil {
+			return movies, fmt.Errorf("page %d: %w", page, err)
+		}
+		movies = append(movies, posterLinks(doc)...)
+
+		next, ok := nextPage(doc, visited, page, url, maxPages)
+		if !ok {
+			return movies, nil
+		}
+		url = next
+	}
+}
+
+// numWorkers calculates how many users are scraped at the same time
+func numWorkers(users int) int {
+	workers := (users / 3) + 1
+	if workers > 12 {
+		workers = 12
+	}
+	if workers < 2 {
+		workers = users
+	}
+	return workers
+}
+
+// friendMovies holds the movies collected from one friend, Err is set
+// if they are incomplete
+type friendMovies struct {
+	User   string
+	Movies []Movie
+	Err    error
+}
+
+// CollectMoviesParallel collects movies from multiple users in parallel.
+// The friends whose ratings are incomplete are returned with the reason.
+// If since or until is set, the friends' diaries are collected instead
+// of their rated films, which are paged up to the number of rated movies
+// in movieCounts, if known. With the estimated number of pages the progress
+// shows the remaining time, based on the recent rate of loaded pages.
+func CollectMoviesParallel(ctx context.Context, friends []string, movieCounts map[string]int, excludeMovies []string, includeMovies []string, maxPerFriend int, since time.Time, until time.Time, estimatedPages int) ([]Movie, map[string]error) {
+	diary := !since.IsZero() || !until.IsZero()
+	var wg sync.WaitGroup
+	moviesChan := make(chan friendMovies, len(friends))
+
+	// Create a semaphore to limit concurrent requests
+	semaphore := make(chan struct{}, numWorkers(len(friends)))
+
+	var pagesDone atomic.Int64
+	onPage := func() { pagesDone.Add(1) }
+
+	for _, friend := range friends {
+		wg.Add(1)
+		go func(username string) {
+			defer wg.Done()
+
+			// Acquire semaphore, unless the collection was cancelled
+			select {
+			case semaphore <- struct{}{}:
+			case <-ctx.Done():
+				moviesChan <- friendMovies{User: username, Err: ctx.Err()}
+				return
+			}
+			defer func() { <-semaphore }()
+
+			var movies []Movie
+			var err error
+			if diary {
+				movies, err = getDiaryMovies(ctx, username, excludeMovies, includeMovies, maxPerFriend, since, onPage)
+			} else {
+				movies, err = getRatedMovies(ctx, username, movieCounts[username], excludeMovies, includeMovies, maxPerFriend, onPage)
+			}
+			moviesChan <- friendMovies{User: username, Movies: movies, Err: err}
+		}(friend)
+	}
+
+	// Wait for all goroutines to complete then close the channel
+	go func() {
+		wg.Wait()
+		close(moviesChan)
+	}()
+
+	// Collect all movies and show the progress on one line, refreshed
+	// every second
+	var allMovies []Movie
+	incomplete := make(map[string]error)
+	done := 0
+	rate, lastPages := 0.0, int64(0)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	printProgress := func() {
+		line := fmt.Sprintf("\r%d/%d friends done, %d movies collected", done, len(friends), len(allMovies))
+		if estimatedPages > 0 && rate > 0 {
+			remaining := max(float64(estimatedPages)-float64(pagesDone.Load()), 0) / rate
+			line += fmt.Sprintf(", ~%.1f min remaining", remaining/60)
+		}
+		// Pad to overwrite a longer previous line
+		Log.Infof("%-80s", line)
+	}
+
+	printProgress()
+	for collecting := true; collecting; {
+		select {
+		case fm, ok := <-moviesChan:
+			if !ok {
+				collecting = false
+				break
+			}
+			allMovies = append(allMovies, fm.Movies...)
+			if fm.Err != nil {
+				incomplete[fm.User] = fm.Err
+			}
+			done++
+			Log.Debug("friend done", "user", fm.User, "movies", len(fm.Movies), "err", fm.Err)
+		case <-ticker.C:
+			// Smooth the pages per second over the last few seconds
+			pages := pagesDone.Load()
+			current := float64(pages - lastPages)
+			lastPages = pages
+			if rate == 0 {
+				rate = current
+			} else {
+				rate = 0.8*rate + 0.2*current
+			}
+		}
+		printProgress()
+	}
+	Log.Infof("\n\n")
+
+	return allMovies, incomplete
+}
+
+// MinCommon is the number of movies a friend has to have rated in
+// common with the user for a meaningful similarity
+const MinCommon = 5
+
+// FriendSimilarity is how similar a friend's ratings are to the user's
+type FriendSimilarity struct {
+	Score  float64 // Pearson correlation, from -1 to 1
+	Common int     // number of movies both rated
+}
+
+// similarities compares the user's ratings with each friend's over the
+// movies both rated. Friends with fewer than MinCommon such movies get
+// a score of 0.
+func similarities(myRatings []Movie, friendsMovies []Movie) map[string]FriendSimilarity {
+	mine := make(map[string]int)
+	for _, m := range myRatings {
+		mine[m.URL] = m.Rating
+	}
+
+	myCommon := make(map[string][]int)
+	theirCommon := make(map[string][]int)
+	for _, m := range friendsMovies {
+		if rating, ok := mine[m.URL]; ok {
+			myCommon[m.User] = append(myCommon[m.User], rating)
+			theirCommon[m.User] = append(theirCommon[m.User], m.Rating)
+		}
+	}
+
+	sims := make(map[string]FriendSimilarity)
+	for friend, ratings := range myCommon {
+		sim := FriendSimilarity{Common: len(ratings)}
+		if len(ratings) >= MinCommon {
+			sim.Score = Pearson(ratings, theirCommon[friend])
+		}
+		sims[friend] = sim
+	}
+	return sims
+}
+
+// similarityWeight is the weight of a friend's rating in the similarity
+// weighted average: 1 + the similarity, so friends with the same taste
+// count twice and friends with the opposite taste not at all. Friends
+// without enough common movies count 1.
+func similarityWeight(sim FriendSimilarity) float64 {
+	if sim.Common < MinCommon {
+		return 1
+	}
+	return 1 + sim.Score
+}
+
+// similarityWeightedAvg averages the ratings, weighting each by how
+// similar its user's taste is to the user's
+func similarityWeightedAvg(ratings []int, users []string, sims map[string]FriendSimilarity) float64 {
+	if len(ratings) == 0 || len(users) != len(ratings) {
+		return avg(ratings)
+	}
+	sum, weights := 0.0, 0.0
+	for i, r := range ratings {
+		w := similarityWeight(sims[users[i]])
+		sum += w * float64(r)
+		weights += w
+	}
+	if weights == 0 {
+		return avg(ratings)
+	}
+	return sum / weights
+}
+
+// addMyRatings sets the user's own rating of every result they rated
+func addMyRatings(results []Result, myRatings []Movie) {
+	mine := make(map[string]int)
+	for _, m := range myRatings {
+		mine[m.URL] = m.Rating
+	}
+	for i := range results {
+		results[i].MyRating = mine[results[i].URL]
+	}
+}
+
+// dropMovies removes the movies whose link is one of the given links
+func dropMovies(movies []Movie, links []string) []Movie {
+	drop := make(map[string]bool)
+	for _, link := range links {
+		drop[link] = true
+	}
+
+	var kept []Movie
+	for _, m := range movies {
+		if !drop[m.URL] {
+			kept = append(kept, m)
+		}
+	}
+	return kept
+}
+
+// RatedPair is a movie rated by both compared users
+type RatedPair struct {
+	URL     string
+	RatingA int
+	RatingB int
+}
+
+// Comparison holds the ratings of two users side by side
+type Comparison struct {
+	Both  []RatedPair
+	OnlyA []Movie
+	OnlyB []Movie
+}
+
+// CompareRatings pairs up the movies both users rated and collects the
+// ones only one of them rated
+func CompareRatings(moviesA []Movie, moviesB []Movie) Comparison {
+	ratingsB := make(map[string]int)
+	for _, m := range moviesB {
+		ratingsB[m.URL] = m.Rating
+	}
+
+	var c Comparison
+	seen := make(map[string]bool)
+	for _, m := range moviesA {
+		seen[m.URL] = true
+		if rating, ok := ratingsB[m.URL]; ok {
+			c.Both = append(c.Both, RatedPair{URL: m.URL, RatingA: m.Rating, RatingB: rating})
+		} else {
+			c.OnlyA = append(c.OnlyA, m)
+		}
+	}
+	for _, m := range moviesB {
+		if !seen[m.URL] {
+			c.OnlyB = append(c.OnlyB, m)
+		}
+	}
+	return c
+}
+
+// lovedBy counts the ratings of LoveRating or more
+func lovedBy(ratings []int) int {
+	count := 0
+	for _, r := range ratings {
+		if r >= LoveRating {
+			count++
+		}
+	}
+	return count
+}
+
+// LoveRating and HateRating mark a movie as loved (4 stars or more) or
+// hated (2 stars or less) in a comparison
+const (
+	LoveRating = 8
+	HateRating = 4
+)
+
+// countFriends gets the number of rated movies of every friend. The
+// friends are returned sorted by that number, friends whose pages can't be
+// loaded are skipped and returned separately. It fails only if no friend
+// could be loaded.
+func countFriends(ctx context.Context, friends []string) (sorted []string, movieCounts map[string]int, skipped []string, err error) {
+	movieCount, countErrs := getMovieCount(ctx, friends)
+
+	// A friend whose pages can't be loaded is skipped, the others are
+	// still used. A friend whose page loaded without a readable count is
+	// kept without one, as they may well have rated films.
+	movieCounts = make(map[string]int)
+	for i, err := range countErrs {
+		switch {
+		case errors.Is(err, errNoCount):
+			Log.Warnf("The number of films \"%s\" rated could not be read, their ratings are collected anyway.\n", friends[i])
+		case err != nil:
+			Log.Warnf("\"%s\" is skipped: %v\n", friends[i], err)
+			skipped = append(skipped, friends[i])
+			continue
+		default:
+			movieCounts[friends[i]] = movieCount[i]
+		}
+		sorted = append(sorted, friends[i])
+	}
+	if len(sorted) == 0 {
+		return nil, nil, skipped, errors.New("the pages of your friends could not be loaded")
+	}
+
+	movieSum := 0
+	for _, friend := range sorted {
+		movieSum += movieCounts[friend]
+	}
+	Log.Infof("%d movies were found.\n", movieSum)
+
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return movieCounts[sorted[i]] > movieCounts[sorted[j]]
+	})
+	return sorted, movieCounts, skipped, nil
+}
+
+// splitEmpty splits the friends into those who rated films and those who
+// haven't, who contribute nothing. Friends whose count is unknown count as
+// rated.
+func splitEmpty(friends []string, movieCounts map[string]int) (rated []string, empty []string) {
+	for _, friend := range friends {
+		if count, known := movieCounts[friend]; known && count == 0 {
+			empty = append(empty, friend)
+		} else {
+			rated = append(rated, friend)
+		}
+	}
+	return rated, empty
+}
+
+// Options configures Aggregate. The zero value ranks the ratings of
+// everyone the user follows.
+type Options struct {
+	Group          []string  // more users the ranking is for, their networks and watched movies are combined with the user's
+	Friends        []string  // used instead of the users' network if set
+	Network        string    // following (default), followers, mutuals or union
+	Depth          int       // 2 to add the users the friends follow
+	ExcludeWatched bool      // leave out the movies the users have watched
+	ExcludeMovies  []string  // movie links to leave out
+	IncludeMovies  []string  // if set, only these movie links are ranked
+	MaxPerFriend   int       // most recently rated movies per friend, 0 for all
+	MinRating      int       // ignore ratings below this (1-10), 0 for all
+	MinVotes       float64   // the Bayesian prior weight, 0 ranks by the plain average
+	Since          time.Time // if set, use the diaries logged since then
+	Until          time.Time // if set, use the diaries logged until then
+	Similarity     bool      // weigh the friends by how similar their taste is
+	MyRatings      bool      // add the user's own rating to every result
+	KeepEmpty      bool      // keep the friends who haven't rated any films
+	Metadata       bool      // fetch the title, year and genres of every movie
+	MinEnrichVotes int       // only fetch the details of movies with this many votes, 0 for all
+	Deadline       time.Time // if set, the collection of the ratings stops then and the ratings collected so far are ranked
+
+	// Stop ends the collection of the ratings early when it is closed,
+	// the ratings collected so far are ranked
+	Stop <-chan struct{}
+	// Retry is asked whether the friends whose pages couldn't be loaded,
+	// e.g. while rate limited, are tried again. Nil never retries.
+	Retry func(skipped []string) bool
+	// Confirm is called with the friends once they are counted, before
+	// their ratings are collected. An error stops Aggregate and is
+	// returned.
+	Confirm func(run *Run) error
+	// Run is filled with what the results are based on if it is set
+	Run *Run
+}
+
+// Run holds the friends and ratings the results of Aggregate are based on
+type Run struct {
+	Friends      []string                    // the friends whose ratings are used, most rated films first
+	MovieCounts  map[string]int              // number of rated films of every counted friend, missing if it couldn't be read
+	Skipped      []string                    // friends whose pages couldn't be loaded
+	Incomplete   map[string]error            // friends whose ratings couldn't all be collected
+	Interrupted  bool                        // Stop ended the collection early
+	Truncated    bool                        // the deadline passed before all ratings were collected
+	Watched      []string                    // movies the users watched, with ExcludeWatched
+	Movies       []Movie                     // every collected rating
+	Merged       []MovieWithRatings          // the ranked ratings merged by movie, before MinRating
+	MyRatings    []Movie                     // the user's own ratings, with Similarity or MyRatings
+	Similarities map[string]FriendSimilarity // how similar every friend's taste is, with Similarity
+}
+
+// Aggregate ranks the movies rated by the friends of user by their
+// Bayesian average. It is the non-interactive core of the command: nothing
+// is read from stdin and every failure is returned instead of exiting,
+// progress is still logged with Log.
+func Aggregate(user string, opts Options) ([]Result, error) {
+	return AggregateContext(context.Background(), user, opts)
+}
+
+// AggregateContext is Aggregate with a context to cancel the scraping
+func AggregateContext(ctx context.Context, user string, opts Options) ([]Result, error) {
+	run := opts.Run
+	if run == nil {
+		run = &Run{}
+	}
+	users := Dedupe(append([]string{user}, opts.Group...))
+
+	// Given friends are only counted, the ones that don't exist are
+	// skipped like those whose pages can't be loaded
+	friends := Dedupe(opts.Friends)
+	if len(friends) == 0 {
+		for _, user := range users {
+			if ok, err := CheckUser(ctx, user); !ok {
+				return nil, fmt.Errorf("checking \"%s\": %w", user, err)
+			}
+		}
+		network := opts.Network
+		if network == "" {
+			network = "following"
+		}
+		if _, ok := Networks[network]; !ok {
+			return nil, fmt.Errorf("unknown network \"%s\"", network)
+		}
+		var err error
+		friends, err = FindNetworks(ctx, users, network)
+		if err != nil {
+			return nil, fmt.Errorf("loading the friends list: %w", err)
+		}
+		if opts.Depth == 2 {
+			friends = ExpandFriends(ctx, users, friends)
+		}
+	}
+	friends = WithoutUsers(friends, users...)
+	if len(friends) == 0 {
+		return nil, errors.New("no friend was found")
+	}
+
+	friends, movieCounts, skipped, _ := countFriends(ctx, friends)
+	for len(skipped) > 0 && opts.Retry != nil && opts.Retry(skipped) {
+		var retried []string
+		var retriedCounts map[string]int
+		retried, retriedCounts, skipped, _ = countFriends(ctx, skipped)
+		for _, friend := range retried {
+			if movieCounts == nil {
+				movieCounts = make(map[string]int)
+			}
+			friends = append(friends, friend)
+			if count, known := retriedCounts[friend]; known {
+				movieCounts[friend] = count
+			}
+		}
+		sort.SliceStable(friends, func(i, j int) bool {
+			return movieCounts[friends[i]] > movieCounts[friends[j]]
+		})
+	}
+	run.Skipped = append(run.Skipped, skipped...)
+	if len(friends) == 0 {
+		return nil, errors.New("the pages of the friends could not be loaded")
+	}
+
+	// Friends without ratings contribute nothing, skipping them saves a
+	// request each
+	rated, empty := splitEmpty(friends, movieCounts)
+	if len(empty) > 0 && !opts.KeepEmpty {
+		Log.Infof("%d friend(s) haven't rated any films and are skipped: %s\n", len(empty), strings.Join(empty, ", "))
+		friends = rated
+		if len(friends) == 0 {
+			return nil, errors.New("no friend has rated any films")
+		}
+	} else if len(empty) > 0 {
+		Log.Warnf("These users haven't rated any films and contribute nothing: %s\n", strings.Join(empty, ", "))
+	}
+	run.Friends = friends
+	run.MovieCounts = movieCounts
+	if opts.Confirm != nil {
+		if err := opts.Confirm(run); err != nil {
+			return nil, err
+		}
+	}
+
+	// With several users, the movies any of them watched are excluded
+	if opts.ExcludeWatched {
+		for _, user := range users {
+			watched, err := getAllMovies(ctx, user)
+			if err != nil {
+				return nil, fmt.Errorf("loading the watched movies of \"%s\": %w", user, err)
+			}
+			run.Watched = append(run.Watched, watched...)
+		}
+		run.Watched = Dedupe(run.Watched)
+		Log.Infof("%d movies found. These will be excluded.\n\n", len(run.Watched))
+	}
+	// The similarity needs the friends' ratings of movies you watched
+	// too, so they are only excluded once it is computed
+	excludeMovies := opts.ExcludeMovies
+	if !opts.Similarity {
+		excludeMovies = append(append([]string{}, excludeMovies...), run.Watched...)
+	}
+
+	// The diary has no known number of pages, so no remaining time is shown
+	diary := !opts.Since.IsZero() || !opts.Until.IsZero()
+	estimatedPages := 0
+	if !diary {
+		scanCounts := make([]int, len(friends))
+		for i, friend := range friends {
+			scanCounts[i] = movieCounts[friend]
+			if opts.MaxPerFriend > 0 {
+				scanCounts[i] = min(movieCounts[friend], opts.MaxPerFriend)
+			}
+		}
+		estimatedPages = TotalPages(scanCounts)
+	}
+
+	// The deadline only bounds the collection, so your own ratings and
+	// the details of the movies are still loaded afterwards
+	deadlineCtx, cancelDeadline := ctx, context.CancelFunc(func() {})
+	if !opts.Deadline.IsZero() {
+		deadlineCtx, cancelDeadline = context.WithDeadline(ctx, opts.Deadline)
+	}
+	defer cancelDeadline()
+	scrapeCtx, cancel := context.WithCancel(deadlineCtx)
+	go func() {
+		select {
+		case <-opts.Stop:
+			cancel()
+		case <-scrapeCtx.Done():
+		}
+	}()
+	run.Movies, run.Incomplete = CollectMoviesParallel(scrapeCtx, friends, movieCounts, excludeMovies, opts.IncludeMovies, opts.MaxPerFriend, opts.Since, opts.Until, estimatedPages)
+	truncated := deadlineCtx.Err() != nil
+	stopped := scrapeCtx.Err() != nil
+	cancel()
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	switch {
+	case truncated:
+		run.Truncated = true
+		Log.Warnf("The deadline was reached, the results only include the ratings collected until then.\n\n")
+	case stopped:
+		run.Interrupted = true
+		Log.Warnf("The collection was interrupted, the results are incomplete.\n\n")
+	case len(run.Incomplete) > 0:
+		collected := make(map[string]bool)
+		for _, m := range run.Movies {
+			collected[m.User] = true
+		}
+
+		Log.Warnf("The ratings of %d friend(s) are incomplete:\n", len(run.Incomplete))
+		for _, friend := range friends {
+			if err, ok := run.Incomplete[friend]; ok {
+				Log.Warnf("\t%s: %v\n", friend, err)
+				if !collected[friend] {
+					run.Skipped = append(run.Skipped, friend)
+				}
+			}
+		}
+		Log.Warnf("\n")
+	}
+
+	movies := run.Movies
+	if opts.Similarity || opts.MyRatings {
+		Log.Infof("Your own ratings are collected...\n")
+		var err error
+		run.MyRatings, err = getRatedMovies(ctx, user, 0, nil, nil, 0, nil)
+		if err != nil && len(run.MyRatings) == 0 {
+			Log.Warnf("Your ratings couldn't be loaded, the results are shown without them: %v\n\n", err)
+		} else if err != nil {
+			Log.Warnf("Your ratings are incomplete: %v\n", err)
+		}
+	}
+	if opts.Similarity {
+		run.Similarities = similarities(run.MyRatings, movies)
+		movies = dropMovies(movies, run.Watched)
+	}
+
+	if diary {
+		movies = filterWatched(movies, opts.Since, opts.Until)
+	}
+
+	Log.Infof("All ratings are combined...\n")
+	sameFilmLinks(movies)
+	run.Merged = mergeMovies(movies)
+	Log.Infof("%d unique and rated movies are found.\n\n", len(run.Merged))
+
+	uniqueMovies := FilterRatings(run.Merged, opts.MinRating)
+	results := ProcessResults(uniqueMovies, movieCounts, opts.MinVotes, run.Similarities)
+	if opts.MyRatings {
+		addMyRatings(results, run.MyRatings)
+	}
+	if opts.Metadata {
+		EnrichResults(ctx, results, opts.MinEnrichVotes)
+		results = MergeCanonical(results, uniqueMovies, movieCounts, opts.MinVotes, run.Similarities)
+	}
+	SortResults(results, "bayes")
+	return results, ctx.Err()
+}
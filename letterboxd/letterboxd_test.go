@@ -0,0 +1,733 @@
+package letterboxd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// approxEqual reports whether two floats are equal up to rounding
+func approxEqual(a, b float64) bool {
+	return math.Abs(a-b) < 1e-9
+}
+
+func TestAvg(t *testing.T) {
+	tests := []struct {
+		name string
+		list []int
+		want float64
+	}{
+		{"empty", nil, 0},
+		{"single", []int{7}, 7},
+		{"all equal", []int{4, 4, 4}, 4},
+		{"mixed", []int{1, 2, 6}, 3},
+		{"out of range", []int{-2, 12}, 5},
+	}
+	for _, tt := range tests {
+		if got := avg(tt.list); !approxEqual(got, tt.want) {
+			t.Errorf("%s: avg(%v) = %v, want %v", tt.name, tt.list, got, tt.want)
+		}
+	}
+}
+
+func TestLeastSquare(t *testing.T) {
+	tests := []struct {
+		name string
+		list []int
+		want float64
+	}{
+		{"empty", nil, 0},
+		{"single", []int{7}, 7},
+		{"all equal", []int{4, 4, 4}, 4},
+		{"mixed", []int{1, 7}, 5},
+		{"out of range", []int{-3, 0}, math.Sqrt(4.5)},
+	}
+	for _, tt := range tests {
+		if got := leastSquare(tt.list); !approxEqual(got, tt.want) {
+			t.Errorf("%s: leastSquare(%v) = %v, want %v", tt.name, tt.list, got, tt.want)
+		}
+	}
+}
+
+func TestWeighted(t *testing.T) {
+	tests := []struct {
+		name string
+		list []int
+		want float64
+	}{
+		{"empty", nil, 0},
+		{"single", []int{6}, 40},
+		// A five-star rating is the top of the weights, not dropped
+		{"top rating", []int{10}, 100},
+		{"half a star", []int{1}, 0},
+		{"all equal", []int{8, 8, 8}, 80},
+		{"low ratings score nothing", []int{1, 2, 3}, 0},
+		{"mixed", []int{4, 10}, 52.5},
+		// Ratings outside 1-10 have no weight and are left out of the
+		// average instead of counting as 0
+		{"only out of range", []int{0, 11, -1}, 0},
+		{"out of range ignored", []int{0, 9, 11, -1}, 95},
+	}
+	for _, tt := range tests {
+		if got := weighted(tt.list); !approxEqual(got, tt.want) {
+			t.Errorf("%s: weighted(%v) = %v, want %v", tt.name, tt.list, got, tt.want)
+		}
+	}
+}
+
+func TestMedian(t *testing.T) {
+	tests := []struct {
+		name string
+		list []int
+		want float64
+	}{
+		{"empty", nil, 0},
+		{"single", []int{7}, 7},
+		{"all equal", []int{4, 4, 4}, 4},
+		{"odd", []int{9, 1, 5}, 5},
+		{"even", []int{10, 1, 4, 6}, 5},
+		{"out of range", []int{-4, 20, 3}, 3},
+	}
+	for _, tt := range tests {
+		list := append([]int(nil), tt.list...)
+		if got := median(list); !approxEqual(got, tt.want) {
+			t.Errorf("%s: median(%v) = %v, want %v", tt.name, tt.list, got, tt.want)
+		}
+		for i := range list {
+			if list[i] != tt.list[i] {
+				t.Errorf("%s: median reordered its input to %v", tt.name, list)
+				break
+			}
+		}
+	}
+}
+
+func TestMode(t *testing.T) {
+	tests := []struct {
+		name string
+		list []int
+		want int
+	}{
+		{"empty", nil, 0},
+		{"single", []int{7}, 7},
+		{"all equal", []int{4, 4, 4}, 4},
+		{"most frequent", []int{2, 8, 2, 6}, 2},
+		{"tie prefers higher", []int{3, 9, 3, 9, 5}, 9},
+		{"out of range", []int{12, 12, -1}, 12},
+	}
+	for _, tt := range tests {
+		if got := mode(tt.list); got != tt.want {
+			t.Errorf("%s: mode(%v) = %v, want %v", tt.name, tt.list, got, tt.want)
+		}
+	}
+}
+
+func TestTMDBMovieKind(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"overview": %q}`, r.URL.Path)
+	}))
+	defer server.Close()
+	tmdb := &TMDB{BaseURL: server.URL, Client: server.Client()}
+
+	tests := []struct {
+		kind string
+		want string
+	}{
+		{"", "/movie/42"},
+		{"movie", "/movie/42"},
+		{"tv", "/tv/42"},
+	}
+	for _, tt := range tests {
+		movie, err := tmdb.Movie(context.Background(), tt.kind, 42)
+		if err != nil {
+			t.Fatalf("%q: %v", tt.kind, err)
+		}
+		if movie.Overview != tt.want {
+			t.Errorf("Movie(%q, 42) requested %s, want %s", tt.kind, movie.Overview, tt.want)
+		}
+	}
+}
+
+// fixtureServer serves the pages in testdata, pages maps a path to the
+// file it is answered with and every other path is not found. Files
+// ending in .gz are sent gzip encoded as they are. The
+// library's fetcher is pointed at the server for the test and the paths
+// requested are returned as they come in.
+func fixtureServer(t *testing.T, pages map[string]string) *[]string {
+	t.Helper()
+	var mu sync.Mutex
+	var requested []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requested = append(requested, r.URL.Path)
+		mu.Unlock()
+		file, ok := pages[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		data, err := os.ReadFile(filepath.Join("testdata", file))
+		if err != nil {
+			t.Error(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if strings.HasSuffix(file, ".gz") {
+			w.Header().Set("Content-Encoding", "gzip")
+		}
+		w.Write(data)
+	}))
+	t.Cleanup(server.Close)
+
+	fetcher := DefaultFetcher
+	DefaultFetcher = NewFetcher()
+	DefaultFetcher.BaseURL = server.URL
+	DefaultFetcher.CheckRobots = false
+	DefaultFetcher.MaxRetries = 2
+	DefaultFetcher.RetryDelay = time.Millisecond
+	t.Cleanup(func() { DefaultFetcher = fetcher })
+	quietLog(t)
+	return &requested
+}
+
+// quietLog discards the library's messages for the test
+func quietLog(t *testing.T) {
+	t.Helper()
+	out, errOut := Log.out, Log.err
+	Log.SetOutput(io.Discard, io.Discard)
+	t.Cleanup(func() { Log.SetOutput(out, errOut) })
+}
+
+func TestGetRatedMoviesPaging(t *testing.T) {
+	requested := fixtureServer(t, map[string]string{
+		"/anna/films/by/member-rating/":        "rated-page-1.html",
+		"/anna/films/by/member-rating/page/2/": "rated-page-2.html",
+		"/anna/films/by/member-rating/page/3/": "rated-page-3.html",
+	})
+
+	movies, err := getRatedMovies(context.Background(), "anna", 0, nil, nil, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, m := range movies {
+		got = append(got, fmt.Sprintf("%s %d", m.URL, m.Rating))
+	}
+	want := []string{"/film/parasite-2019/ 10", "/film/arrival-2016/ 9", "/film/dune-2021/ 8", "/film/cats-2019/ 2"}
+	if !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if len(*requested) != 3 {
+		t.Errorf("requested %v, want the 3 pages once each", *requested)
+	}
+}
+
+func TestGetRatedMoviesStopsAtUnratedPage(t *testing.T) {
+	// The unrated page still links to a third page, which doesn't exist
+	requested := fixtureServer(t, map[string]string{
+		"/anna/films/by/member-rating/":        "rated-page-1.html",
+		"/anna/films/by/member-rating/page/2/": "unrated-page.html",
+	})
+
+	movies, err := getRatedMovies(context.Background(), "anna", 0, nil, nil, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(movies) != 2 {
+		t.Errorf("got %d movies, want the 2 rated ones", len(movies))
+	}
+	if slices.Contains(*requested, "/anna/films/by/member-rating/page/3/") {
+		t.Errorf("the page after the unrated one was requested: %v", *requested)
+	}
+}
+
+func TestGetRatedMoviesNotFound(t *testing.T) {
+	requested := fixtureServer(t, nil)
+
+	movies, err := getRatedMovies(context.Background(), "nobody", 0, nil, nil, 0, nil)
+	if !errors.Is(err, errNotFound) {
+		t.Errorf("got error %v, want %v", err, errNotFound)
+	}
+	if len(movies) != 0 {
+		t.Errorf("got %d movies from a missing page", len(movies))
+	}
+	// A missing page isn't retried
+	if len(*requested) != 1 {
+		t.Errorf("requested %v, want one request", *requested)
+	}
+}
+
+func TestGetRatedMoviesBrokenPage(t *testing.T) {
+	requested := fixtureServer(t, map[string]string{
+		"/anna/films/by/member-rating/": "broken-page.html",
+	})
+
+	_, err := getRatedMovies(context.Background(), "anna", 0, nil, nil, 0, nil)
+	if !errors.Is(err, errInvalidPage) {
+		t.Errorf("got error %v, want %v", err, errInvalidPage)
+	}
+	// Only the fetcher retries the page
+	if len(*requested) != DefaultFetcher.MaxRetries {
+		t.Errorf("requested %v, want %d requests", *requested, DefaultFetcher.MaxRetries)
+	}
+}
+
+func TestFindFollowingPaging(t *testing.T) {
+	fixtureServer(t, map[string]string{
+		"/anna/following/":        "following-page-1.html",
+		"/anna/following/page/2/": "following-page-2.html",
+	})
+
+	users, err := findFollowing(context.Background(), "anna")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"ben", "carl", "dora"}; !slices.Equal(users, want) {
+		t.Errorf("got %v, want %v", users, want)
+	}
+}
+
+func TestGetRatedMoviesCyclicPaging(t *testing.T) {
+	// The second page links back to the first one
+	requested := fixtureServer(t, map[string]string{
+		"/anna/films/by/member-rating/":        "rated-page-1.html",
+		"/anna/films/by/member-rating/page/2/": "cyclic-page-2.html",
+	})
+
+	movies, err := getRatedMovies(context.Background(), "anna", 0, nil, nil, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(movies) != 3 {
+		t.Errorf("got %d movies, want the 3 of both pages once", len(movies))
+	}
+	if len(*requested) != 2 {
+		t.Errorf("requested %v, want both pages once", *requested)
+	}
+}
+
+func TestPageLimit(t *testing.T) {
+	tests := []struct {
+		name    string
+		count   int
+		perPage int
+		want    int
+	}{
+		{"unknown", 0, moviesPerPage, maxPages},
+		{"one movie", 1, moviesPerPage, 1 + pageSlack},
+		{"full page", moviesPerPage, moviesPerPage, 1 + pageSlack},
+		{"one more", moviesPerPage + 1, moviesPerPage, 2 + pageSlack},
+		{"friends", 60, FriendsPerPage, 3 + pageSlack},
+	}
+	for _, tt := range tests {
+		if got := pageLimit(tt.count, tt.perPage); got != tt.want {
+			t.Errorf("%s: pageLimit(%d, %d) = %d, want %d", tt.name, tt.count, tt.perPage, got, tt.want)
+		}
+	}
+}
+
+// sortMergeMovies is mergeMovies as it was before it grouped with a map,
+// sorting all ratings by movie and user
+func sortMergeMovies(movies []Movie) []MovieWithRatings {
+	sort.Slice(movies, func(i, j int) bool {
+		if movies[i].URL != movies[j].URL {
+			return movies[i].URL < movies[j].URL
+		}
+		return movies[i].User < movies[j].User
+	})
+
+	var uniqueMovies []MovieWithRatings
+	i := 0
+	for i < len(movies) {
+		movie := movies[i]
+		ratings := []int{movie.Rating}
+		users := []string{movie.User}
+
+		j := i + 1
+		for j < len(movies) && movies[j].URL == movie.URL {
+			ratings = append(ratings, movies[j].Rating)
+			users = append(users, movies[j].User)
+			j++
+		}
+
+		uniqueMovies = append(uniqueMovies, MovieWithRatings{
+			URL:     movie.URL,
+			Ratings: ratings,
+			Users:   users,
+		})
+
+		i = j
+	}
+	return uniqueMovies
+}
+
+// randomRatings returns the ratings of the given number of friends of
+// random movies, every friend rating a movie at most once
+func randomRatings(rng *rand.Rand, friends int, perFriend int, films int) []Movie {
+	var movies []Movie
+	for f := 0; f < friends; f++ {
+		user := fmt.Sprintf("friend%d", f)
+		for _, film := range rng.Perm(films)[:perFriend] {
+			movies = append(movies, Movie{
+				URL:    fmt.Sprintf("/film/film-%d/", film),
+				Rating: 1 + rng.Intn(10),
+				User:   user,
+			})
+		}
+	}
+	rng.Shuffle(len(movies), func(i, j int) { movies[i], movies[j] = movies[j], movies[i] })
+	return movies
+}
+
+func TestMergeMoviesMatchesSorting(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for run := 0; run < 50; run++ {
+		movies := randomRatings(rng, 1+rng.Intn(20), 1+rng.Intn(30), 30+rng.Intn(50))
+		got := mergeMovies(movies)
+		want := sortMergeMovies(append([]Movie(nil), movies...))
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("run %d: mergeMovies differs from sorting all ratings:\ngot  %v\nwant %v", run, got, want)
+		}
+	}
+}
+
+func BenchmarkMergeMovies(b *testing.B) {
+	movies := randomRatings(rand.New(rand.NewSource(1)), 100, 1000, 20000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		mergeMovies(movies)
+	}
+}
+
+// useMetaCache empties the movie details for the test
+func useMetaCache(t *testing.T) {
+	t.Helper()
+	metaMu.Lock()
+	saved := metaCache
+	metaCache = make(map[string]Meta)
+	metaMu.Unlock()
+	t.Cleanup(func() {
+		metaMu.Lock()
+		metaCache = saved
+		metaMu.Unlock()
+	})
+}
+
+func TestMergeCanonical(t *testing.T) {
+	useMetaCache(t)
+	fixtureServer(t, map[string]string{
+		// An old slug is answered with the page it redirects to
+		"/film/dune/":                   "film-dune-2021.html",
+		"/film/dune-2021/":              "film-dune-2021.html",
+		"/film/blade-runner/":           "film-blade-runner.html",
+		"/film/blade-runner-final-cut/": "film-blade-runner-final-cut.html",
+		"/film/the-office-2005/":        "film-the-office.html",
+		"/film/some-movie/":             "film-some-movie.html",
+	})
+
+	movies := []MovieWithRatings{
+		{URL: "/film/blade-runner/", Ratings: []int{8}, Users: []string{"anna"}},
+		{URL: "/film/blade-runner-final-cut/", Ratings: []int{10}, Users: []string{"ben"}},
+		{URL: "/film/dune-2021/", Ratings: []int{8}, Users: []string{"anna"}},
+		{URL: "/film/dune/", Ratings: []int{6}, Users: []string{"ben"}},
+		{URL: "/film/some-movie/", Ratings: []int{4}, Users: []string{"anna"}},
+		{URL: "/film/the-office-2005/", Ratings: []int{9}, Users: []string{"ben"}},
+	}
+	counts := map[string]int{"anna": 10, "ben": 10}
+	results := ProcessResults(movies, counts, 0, nil)
+	EnrichResults(context.Background(), results, 0)
+	merged := MergeCanonical(results, movies, counts, 0, nil)
+
+	votes := make(map[string]int)
+	for _, r := range merged {
+		votes[r.URL] = r.VoteCount
+	}
+	want := map[string]int{
+		// The same TMDB id
+		"/film/blade-runner/": 2,
+		// Two slugs with the same canonical page
+		"/film/dune-2021/": 2,
+		// A show and a movie with the same id are different entries
+		"/film/some-movie/":      1,
+		"/film/the-office-2005/": 1,
+	}
+	if !reflect.DeepEqual(votes, want) {
+		t.Errorf("got the votes %v, want %v", votes, want)
+	}
+	for _, r := range merged {
+		if r.URL == "/film/the-office-2005/" && r.TMDBType != "tv" {
+			t.Errorf("the show has the TMDB type %q, want \"tv\"", r.TMDBType)
+		}
+	}
+}
+
+func TestSameFilmLinksMergesSplitVotes(t *testing.T) {
+	movies := []Movie{
+		{URL: "/film/dune-2021/", Rating: 8, User: "anna", FilmID: "1"},
+		{URL: "/film/dune/", Rating: 6, User: "ben", FilmID: "1"},
+		{URL: "/film/arrival/", Rating: 9, User: "ben", FilmID: "2"},
+		{URL: "/film/old-file/", Rating: 7, User: "carl"},
+	}
+	sameFilmLinks(movies)
+	merged := mergeMovies(movies)
+
+	if len(merged) != 3 {
+		t.Fatalf("got %d movies, want 3: %v", len(merged), merged)
+	}
+	// On a tie the first link alphabetically is kept
+	dune := merged[1]
+	if dune.URL != "/film/dune-2021/" || len(dune.Ratings) != 2 {
+		t.Errorf("the split film merged to %+v, want both votes under /film/dune-2021/", dune)
+	}
+}
+
+func TestFindFollowingRepeatedUser(t *testing.T) {
+	// The second page repeats carl from the first one and lists dora twice
+	fixtureServer(t, map[string]string{
+		"/anna/following/":        "following-page-1.html",
+		"/anna/following/page/2/": "following-repeated-page-2.html",
+	})
+
+	users, err := findFollowing(context.Background(), "anna")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"ben", "carl", "dora"}; !slices.Equal(users, want) {
+		t.Errorf("got %v, want %v", users, want)
+	}
+}
+
+func TestDedupe(t *testing.T) {
+	tests := []struct {
+		name  string
+		users []string
+		want  []string
+	}{
+		{"empty", nil, nil},
+		{"unique", []string{"ben", "carl"}, []string{"ben", "carl"}},
+		{"typed and followed", []string{"ben", "carl", "ben"}, []string{"ben", "carl"}},
+		{"other case", []string{"Ben", "ben"}, []string{"Ben"}},
+	}
+	for _, tt := range tests {
+		if got := Dedupe(tt.users); !slices.Equal(got, tt.want) {
+			t.Errorf("%s: Dedupe(%v) = %v, want %v", tt.name, tt.users, got, tt.want)
+		}
+	}
+}
+
+func TestHyphenatedUserIsScraped(t *testing.T) {
+	// Letterboxd allows hyphens, which the alphanumeric check rejected
+	fixtureServer(t, map[string]string{
+		"/film-nerd":                         "profile-page.html",
+		"/film-nerd/films/by/member-rating/": "rated-page-3.html",
+	})
+
+	tests := []struct {
+		username string
+		valid    bool
+	}{
+		{"film-nerd", true},
+		{"film_nerd", true},
+		{"FilmNerd42", true},
+		{"film nerd", false},
+		{"film/nerd", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := validUsername.MatchString(tt.username); got != tt.valid {
+			t.Errorf("validUsername(%q) = %v, want %v", tt.username, got, tt.valid)
+		}
+	}
+
+	if ok, err := CheckUser(context.Background(), "film-nerd"); !ok {
+		t.Fatalf("CheckUser rejected film-nerd: %v", err)
+	}
+	movies, err := getRatedMovies(context.Background(), "film-nerd", 0, nil, nil, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(movies) != 1 || movies[0].User != "film-nerd" {
+		t.Errorf("got %v, want the rating of film-nerd", movies)
+	}
+}
+
+func TestCountRatedMoviesThousands(t *testing.T) {
+	// The digits in the username aren't part of the count
+	fixtureServer(t, map[string]string{
+		"/cinephile2001/films/rated/.5-5/": "rated-count-page.html",
+	})
+
+	count, err := countRatedMovies(context.Background(), "cinephile2001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 12345 {
+		t.Errorf("got %d rated films, want 12345", count)
+	}
+}
+
+func TestParseCount(t *testing.T) {
+	tests := []struct {
+		text  string
+		want  int
+		found bool
+	}{
+		{"has rated no films", 0, false},
+		{"", 0, false},
+		{"has rated 0 films", 0, true},
+		{"has rated 7 films", 7, true},
+		{"has rated 12,345 films", 12345, true},
+		{"hat 12.345 Filme bewertet", 12345, true},
+		{"a noté 12 345 films", 12345, true},
+		{"has rated 1,234,567 films", 1234567, true},
+	}
+	for _, tt := range tests {
+		if got, found := parseCount(tt.text); got != tt.want || found != tt.found {
+			t.Errorf("parseCount(%q) = %d, %v, want %d, %v", tt.text, got, found, tt.want, tt.found)
+		}
+	}
+}
+
+func TestWithoutUsers(t *testing.T) {
+	quietLog(t)
+	tests := []struct {
+		name    string
+		friends []string
+		users   []string
+		want    []string
+	}{
+		{"no self", []string{"ben", "carl"}, []string{"anna"}, []string{"ben", "carl"}},
+		{"self typed as a friend", []string{"ben", "anna", "carl"}, []string{"anna"}, []string{"ben", "carl"}},
+		{"other case", []string{"Anna", "ben"}, []string{"anna"}, []string{"ben"}},
+		{"group members", []string{"anna", "ben", "carl"}, []string{"anna", "carl"}, []string{"ben"}},
+		{"only self", []string{"anna"}, []string{"anna"}, nil},
+	}
+	for _, tt := range tests {
+		if got := WithoutUsers(tt.friends, tt.users...); !slices.Equal(got, tt.want) {
+			t.Errorf("%s: WithoutUsers(%v, %v) = %v, want %v", tt.name, tt.friends, tt.users, got, tt.want)
+		}
+	}
+}
+
+func TestGzipPageParsesLikePlain(t *testing.T) {
+	fixtureServer(t, map[string]string{
+		"/anna/films/by/member-rating/": "rated-page-3.html",
+		"/ben/films/by/member-rating/":  "rated-page-3.html.gz",
+	})
+
+	plain, err := getRatedMovies(context.Background(), "anna", 0, nil, nil, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	compressed, err := getRatedMovies(context.Background(), "ben", 0, nil, nil, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plain) == 0 || len(plain) != len(compressed) {
+		t.Fatalf("got %d movies from the gzip page and %d from the plain one", len(compressed), len(plain))
+	}
+	for i := range plain {
+		if plain[i].URL != compressed[i].URL || plain[i].Rating != compressed[i].Rating {
+			t.Errorf("movie %d is %+v from the gzip page, %+v from the plain one", i, compressed[i], plain[i])
+		}
+	}
+}
+
+func TestCountRatedMoviesUnreadable(t *testing.T) {
+	// A profile page has no rated count, an empty heading has no number
+	fixtureServer(t, map[string]string{
+		"/nocount/films/rated/.5-5/":  "profile-page.html",
+		"/nonumber/films/rated/.5-5/": "rated-count-missing-page.html",
+		"/newbie/films/rated/.5-5/":   "rated-count-zero-page.html",
+	})
+
+	for _, user := range []string{"nocount", "nonumber"} {
+		if count, err := countRatedMovies(context.Background(), user); !errors.Is(err, errNoCount) {
+			t.Errorf("%s: got %d, %v, want %v", user, count, err, errNoCount)
+		}
+	}
+	if count, err := countRatedMovies(context.Background(), "newbie"); count != 0 || err != nil {
+		t.Errorf("newbie: got %d, %v, want 0 rated films", count, err)
+	}
+}
+
+func TestCountRatedMoviesAfterName(t *testing.T) {
+	// The name also appears before the span, only the text after it counts
+	fixtureServer(t, map[string]string{
+		"/seen3/films/rated/.5-5/": "rated-count-name-page.html",
+	})
+
+	count, err := countRatedMovies(context.Background(), "seen3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 1024 {
+		t.Errorf("got %d rated films, want 1024", count)
+	}
+}
+
+func TestCountFriendsKeepsUnreadableCounts(t *testing.T) {
+	fixtureServer(t, map[string]string{
+		"/cinephile2001/films/rated/.5-5/": "rated-count-page.html",
+		"/nonumber/films/rated/.5-5/":      "rated-count-missing-page.html",
+		"/newbie/films/rated/.5-5/":        "rated-count-zero-page.html",
+	})
+
+	friends, counts, skipped, err := countFriends(context.Background(), []string{"newbie", "nonumber", "cinephile2001", "gone"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"cinephile2001", "newbie", "nonumber"}; !slices.Equal(friends, want) {
+		t.Errorf("got the friends %v, want %v", friends, want)
+	}
+	if want := []string{"gone"}; !slices.Equal(skipped, want) {
+		t.Errorf("skipped %v, want %v", skipped, want)
+	}
+
+	// Only the friend who rated none is empty, not the unreadable one
+	rated, empty := splitEmpty(friends, counts)
+	if want := []string{"cinephile2001", "nonumber"}; !slices.Equal(rated, want) {
+		t.Errorf("got the rated friends %v, want %v", rated, want)
+	}
+	if want := []string{"newbie"}; !slices.Equal(empty, want) {
+		t.Errorf("got the empty friends %v, want %v", empty, want)
+	}
+}
+
+func TestLoggerLevelsAndJSON(t *testing.T) {
+	var out, errOut strings.Builder
+	l := NewLogger()
+	l.SetOutput(&out, &errOut)
+	l.SetLevel(LevelWarn)
+	l.Infof("progress\n")
+	l.Warnf("careful\n")
+	l.Debug("fetch", "url", "/film/the-matrix/")
+	if out.String() != "" || errOut.String() != "careful\n" {
+		t.Errorf("got %q on stdout and %q on stderr, want only the warning on stderr", out.String(), errOut.String())
+	}
+
+	// The level set before switching to JSON still applies
+	errOut.Reset()
+	l.SetJSON(true)
+	l.Infof("progress\n")
+	l.Errorf("failed\n")
+	if lines := strings.Split(strings.TrimSpace(errOut.String()), "\n"); len(lines) != 1 ||
+		!strings.Contains(lines[0], `"level":"ERROR"`) || !strings.Contains(lines[0], `"msg":"failed"`) {
+		t.Errorf("got %q, want one JSON record of the error", errOut.String())
+	}
+}
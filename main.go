@@ -2,138 +2,640 @@ package main
 
 import (
 	"bufio"
+	"context"
+	"embed"
 	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"html/template"
+	"io"
 	"math"
-	"net/http"
 	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"runtime"
 	"sort"
 	"strconv"
 	"strings"
-	"sync"
+	texttemplate "text/template"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
-	"github.com/PuerkitoBio/goquery"
+	"github.com/birthtothunder/Letterboxd-Top-Movies-as-Rated-by-Friends/letterboxd"
 )
 
-// Movie represents a movie with its URL and rating
-type Movie struct {
-	URL    string
-	Rating int
-}
+// logger and fetcher are the library's, the flags configure them
+var (
+	logger  = letterboxd.Log
+	fetcher = letterboxd.DefaultFetcher
+)
 
-// MovieWithRatings represents a movie with multiple ratings
-type MovieWithRatings struct {
-	URL     string
-	Ratings []int
-}
+// percentScale is whether saved ratings are from 10 to 100 instead of
+// stars, set with -percent. Ratings are multiplied by 10, so half a star
+// is 10 and five stars are 100.
+var percentScale bool
 
-// Result represents the processed movie data for display
-type Result struct {
-	AvgRating float64
-	VoteCount int
-	URL       string
-	Ratings   []int
-}
+// metaCache is the file the movie details are saved to when the program
+// ends, set with -meta-cache once the file is loaded
+var metaCache string
 
-// Helper functions for calculations
-func avg(list []int) float64 {
-	if len(list) == 0 {
-		return 0
+// saveMetaCache saves the movie details to metaCache, if one is used
+func saveMetaCache() {
+	if metaCache == "" {
+		return
 	}
-	sum := 0
-	for _, v := range list {
-		sum += v
+	if err := letterboxd.SaveMetaCache(metaCache); err != nil {
+		logger.Errorf("Error saving the movie details: %v\n", err)
 	}
-	return float64(sum) / float64(len(list))
 }
 
-func leastSquare(list []int) float64 {
-	if len(list) == 0 {
-		return 0
+// exit ends the program with code. os.Exit skips deferred calls, so the
+// movie details are saved first.
+func exit(code int) {
+	saveMetaCache()
+	os.Exit(code)
+}
+
+// exported converts a rating on the 1-10 scale to the scale of the
+// saved results
+func exported(rating float64) float64 {
+	if percentScale {
+		return rating * 10
 	}
-	sum := 0
-	for _, v := range list {
-		sum += v * v
+	return letterboxd.Stars(rating)
+}
+
+// exportedList converts ratings on the 1-10 scale to the scale of the
+// saved results
+func exportedList(list []int) []float64 {
+	converted := make([]float64, len(list))
+	for i, r := range list {
+		converted[i] = exported(float64(r))
 	}
-	return math.Sqrt(float64(sum) / float64(len(list)))
+	return converted
 }
 
-func weighted(list []int) float64 {
-	if len(list) == 0 {
-		return 0
+// exportedMyRating formats the own rating for the saved results, "—"
+// if it is missing
+func exportedMyRating(rating int) string {
+	if !percentScale {
+		return myRatingString(rating)
 	}
-	weights := []int{100, 95, 80, 65, 40, 20, 5, 0, 0, 0}
-	wList := make([]int, 0, len(list))
-	for _, i := range list {
-		if i >= 0 && i < len(weights) {
-			wList = append(wList, weights[i])
-		}
+	if rating == 0 {
+		return "—"
 	}
-	return avg(wList)
+	return strconv.Itoa(rating * 10)
 }
 
 // Letterboxd represents the main application
 type Letterboxd struct {
-	User     string
-	Friends  []string
-	MyMovies []string
-	Movies   []Movie
+	User         string
+	Users        []string
+	Network      string
+	Depth        int
+	Friends      []string
+	MovieCounts  map[string]int
+	MyMovies     []string
+	MyRatings    []letterboxd.Movie
+	Movies       []letterboxd.Movie
+	Merged       []letterboxd.MovieWithRatings // the ratings the results are based on, merged by movie
+	Similarities map[string]letterboxd.FriendSimilarity
+	Skipped      []string
+
+	// Settings taken from the command line
+	ExcludeWatched bool
+	Threshold      int
+	Output         string
+	SaveAll        bool
+	Format         string
+	SortBy         string
+	SaveRaw        string
+	Histogram      string
+	LoadRaw        string
+	SinceRun       string
+	Top            int
+	MinFriends     int
+	SkipEmpty      bool
+	LineTemplate   *texttemplate.Template
+	ExcludeFile    string
+	FriendsFile    string
+	SaveFriends    string
+	FriendsReport  string
+	List           string
+	Compare        []string
+	Similarity     bool
+	ShowMine       bool
+	ShowRaters     bool
+	Metadata       bool
+	MinEnrichVotes int // fetch the details of movies with this many votes, 0 for the threshold
+	EnrichedFrom   int // votes the details were fetched from so far, 0 for none
+	MetaCache      string
+	TMDBKey        string
+	MinYear        int
+	MaxYear        int
+	MinRuntime     int
+	MaxRuntime     int
+	MinPopularity  int
+	Genres         []string
+	DryRun         bool
+	MaxPerFriend   int
+	MinRating      int
+	MinAvg         float64
+	MinLoved       int
+	MinVotes       float64
+	Since          time.Time
+	Until          time.Time
+	WarnMovies     int
+	PagesPerSecond float64
+	Yes            bool
+	Interactive    bool
+	Deadline       time.Duration
+	Truncated      bool
 }
 
-// getPage fetches and parses a web page
-func getPage(url string) (*goquery.Document, error) {
-	client := &http.Client{
-		Timeout: 10 * time.Second,
+// parseFlags builds a Letterboxd run from the command-line arguments
+// and the config file. When -user is given the run is non-interactive
+// and every setting that was not passed falls back to its default
+// instead of a prompt. Settings from the config file are used for every
+// flag that isn't passed, and count as answered prompts.
+func parseFlags() (*Letterboxd, map[string]bool) {
+	config := flag.String("config", defaultConfigPath(), "config file with default settings")
+	user := flag.String("user", "", "your Letterboxd username, or several comma separated ones whose networks are combined (skips all prompts)")
+	friends := flag.String("friends", "", "comma separated list of friends (default: everyone in -network)")
+	friendsFile := flag.String("friends-file", "", "file with newline separated friends, e.g. saved with -save-friends")
+	saveFriends := flag.String("save-friends", "", "file the friends are saved to, for -friends-file")
+	friendsReport := flag.String("friends-report", "", "file the friends' rated and collected movies are reported in, as JSON if it ends in .json and CSV otherwise")
+	network := flag.String("network", "following", "users the friends list is generated from: following, followers, mutuals or union")
+	depth := flag.Int("depth", 1, "1 for your friends, 2 to also include the users your friends follow")
+	excludeWatched := flag.Bool("exclude-watched", false, "exclude the movies you have already watched")
+	threshold := flag.Int("threshold", 0, "minimum number of ratings per movie")
+	output := flag.String("output", "", "file the complete results are saved to")
+	outputDir := flag.String("output-dir", "", "directory the results of a run with -user are saved to, named by the date and time, e.g. results-2024-06-01-083000.csv")
+	saveAll := flag.Bool("save-all", false, "save the results once per sort metric, e.g. results-avg.csv and results-bayes.csv for -output results.csv")
+	format := flag.String("format", "", "format of the saved results: csv, json, jsonl, html or letterboxd for a list import file (default: from the file extension)")
+	flag.DurationVar(&fetcher.Timeout, "timeout", fetcher.Timeout, "timeout of a single request")
+	flag.IntVar(&fetcher.MaxRetries, "retries", fetcher.MaxRetries, "number of attempts per request")
+	flag.DurationVar(&fetcher.RetryDelay, "retry-delay", fetcher.RetryDelay, "delay before the first retry, doubled on every further retry")
+	flag.DurationVar(&fetcher.MaxDelay, "max-retry-delay", fetcher.MaxDelay, "maximum delay between two attempts")
+	flag.Float64Var(&fetcher.RateLimit, "rate", fetcher.RateLimit, "maximum requests per second, 0 for no limit")
+	flag.StringVar(&fetcher.CacheDir, "cache-dir", "", "directory fetched pages are cached in (default: no cache)")
+	flag.DurationVar(&fetcher.CacheTTL, "cache-ttl", fetcher.CacheTTL, "how long cached pages are reused, 0 for forever")
+	flag.StringVar(&fetcher.UserAgent, "user-agent", fetcher.UserAgent, "User-Agent header sent with every request")
+	flag.BoolVar(&fetcher.CheckRobots, "robots", fetcher.CheckRobots, "warn about pages Letterboxd's robots.txt disallows")
+	saveRaw := flag.String("save-raw", "", "file the merged ratings are saved to as JSON")
+	histogram := flag.String("histogram", "", "file the distribution of all collected ratings is saved to as CSV")
+	loadRaw := flag.String("load-raw", "", "file with merged ratings to use instead of scraping")
+	sinceRun := flag.String("since-run", "", "file with merged ratings of an earlier run (see -save-raw), the changes since then are shown")
+	excludeFile := flag.String("exclude-file", "", "file with newline separated /film/... slugs that are excluded")
+	list := flag.String("list", "", "URL of a Letterboxd list, only its movies are ranked")
+	compare := flag.String("compare", "", "two comma separated users whose ratings are compared with each other")
+	similarity := flag.Bool("similarity", false, "show which friends rate most like you")
+	showMine := flag.Bool("my-rating", false, "show your own rating next to your friends' ratings")
+	showRaters := flag.Bool("raters", false, "show which friend gave each of the individual votes")
+	metadata := flag.Bool("metadata", true, "fetch the title and year of every movie")
+	minEnrichVotes := flag.Int("min-votes-to-enrich", 0, "only fetch the details of movies with at least this many votes (default: the -threshold)")
+	metaCacheFile := flag.String("meta-cache", "", "JSON file the movie details are kept in between runs, only new movies are fetched")
+	tmdbKey := flag.String("tmdb-key", "", "TMDB API key to add posters and overviews to the HTML report (default $TMDB_API_KEY)")
+	minYear := flag.Int("min-year", 0, "only show movies released in or after this year")
+	minPopularity := flag.Int("min-popularity", 0, "only show movies with at least this many ratings on all of Letterboxd")
+	minRuntime := flag.Int("min-runtime", 0, "only show movies running at least this many minutes")
+	maxRuntime := flag.Int("max-runtime", 0, "only show movies running at most this many minutes")
+	maxYear := flag.Int("max-year", 0, "only show movies released in or before this year")
+	genres := flag.String("genre", "", "comma separated genres, only movies with one of them are shown")
+	maxPerFriend := flag.Int("max-per-friend", 0, "only collect each friend's N most recently rated films, 0 for all")
+	minRating := flag.Int("min-rating", 0, "ignore ratings below this value, from 1 (half a star) to 10 (five stars)")
+	minLoved := flag.Int("min-loved", 0, "only show movies at least this many friends rated 4 stars or more")
+	minAvg := flag.Float64("min-avg", 0, "only show movies with at least this average rating, from 1 (half a star) to 10 (five stars)")
+	recommend := flag.Bool("recommend", false, "what to watch next: excludes your watched movies and only shows movies at least 2 friends rated 4 stars on average")
+	quiet := flag.Bool("quiet", false, "only print the results, warnings and errors")
+	verbose := flag.Bool("verbose", false, "also print diagnostic messages about the scraped pages")
+	logLevel := flag.String("log-level", "", "messages that are printed: error, warn, info or debug (default info, see -quiet and -verbose)")
+	logJSON := flag.Bool("log-json", false, "write all messages as JSON records to stderr, keeping stdout for the results")
+	flag.BoolVar(&percentScale, "percent", false, "save the ratings from 10 (half a star) to 100 (five stars) instead of in stars")
+	noColor := flag.Bool("no-color", false, "print the results without colors (default: colors only in a terminal)")
+	dryRun := flag.Bool("dry-run", false, "only estimate the number of requests a run needs")
+	warnMovies := flag.Int("warn-movies", 3000, "ask for confirmation before searching more movies than this")
+	pagesPerSecond := flag.Float64("pages-per-second", 4, "pages loaded per second, used to estimate the duration of a run")
+	yes := flag.Bool("yes", false, "start without asking for confirmation")
+	top := flag.Int("top", 15, "number of movies that are printed")
+	deadline := flag.Duration("deadline", 0, "stop collecting the ratings after this long, e.g. 20m, and show what was collected so far (default: no limit)")
+	skipEmpty := flag.Bool("skip-empty", true, "skip the friends who haven't rated any films")
+	minFriends := flag.Int("min-friends", 3, "warn when fewer friends are used, 0 to never warn")
+	lineTemplate := flag.String("line-template", "", "Go template every printed movie is formatted with, e.g. '{{.Title}} ({{.Year}}): {{stars .AvgRating}}'")
+	sortBy := flag.String("sort", "bayes", "metric the results are ranked by: bayes, avg, weighted, rms, count, controversy, gems, votes or similar (implies -similarity)")
+	minVotes := flag.Float64("min-votes", 3, "votes of the overall mean added to every movie for the Bayesian average")
+	since := flag.String("since", "", "only use diary entries logged on or after this date (YYYY-MM-DD)")
+	until := flag.String("until", "", "only use diary entries logged on or before this date (YYYY-MM-DD)")
+	flag.Parse()
+
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+
+	// Settings from the config file apply to every flag not passed
+	settings, err := loadConfig(*config)
+	if err != nil && (set["config"] || !errors.Is(err, os.ErrNotExist)) {
+		fmt.Fprintf(os.Stderr, "Error reading config file: %v\n", err)
+		os.Exit(2)
+	}
+	for name, value := range settings {
+		if set[name] {
+			continue
+		}
+		if name == "config" || flag.Lookup(name) == nil {
+			fmt.Fprintf(os.Stderr, "Unknown setting \"%s\" in %s.\n", name, *config)
+			os.Exit(2)
+		}
+		if err := flag.Set(name, value); err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid setting \"%s\" in %s: %v\n", name, *config, err)
+			os.Exit(2)
+		}
+		set[name] = true
 	}
 
-	for retry := 0; retry < 10; retry++ {
-		resp, err := client.Get(url)
-		if err == nil {
-			defer resp.Body.Close()
-			if resp.StatusCode == 200 {
-				return goquery.NewDocumentFromReader(resp.Body)
+	// A -user from the config file makes the run non-interactive as well
+	interactive := *user == ""
+
+	// -recommend only changes the defaults, passed settings still apply
+	if *recommend {
+		for name, value := range recommendDefaults {
+			if !set[name] {
+				flag.Set(name, value)
+				set[name] = true
 			}
 		}
+	}
+
+	if _, ok := letterboxd.SortMetrics[*sortBy]; !ok {
+		fmt.Fprintf(os.Stderr, "Unknown sort metric \"%s\".\n", *sortBy)
+		flag.Usage()
+		os.Exit(2)
+	}
+	if *sortBy == "similar" {
+		*similarity = true
+	}
+
+	*format = strings.ToLower(strings.TrimSpace(*format))
+	switch *format {
+	case "", "csv", "json", "jsonl", "html", "letterboxd":
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown format \"%s\".\n", *format)
+		flag.Usage()
+		os.Exit(2)
+	}
+	// Without a prompt the results in -output-dir get a dated name, so
+	// scheduled runs keep a history
+	if strings.TrimSpace(*outputDir) != "" && interactive {
+		fmt.Fprintln(os.Stderr, "-output-dir is only used with -user, the filename is asked for instead.")
+	}
+	if dir := strings.TrimSpace(*outputDir); dir != "" && strings.TrimSpace(*output) == "" && !interactive {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			fmt.Fprintf(os.Stderr, "Error creating the output directory: %v\n", err)
+			os.Exit(1)
+		}
+		*output = datedFilename(dir, *format, time.Now())
+	}
+	if _, ok := letterboxd.Networks[*network]; !ok {
+		fmt.Fprintf(os.Stderr, "Unknown network \"%s\".\n", *network)
+		flag.Usage()
+		os.Exit(2)
+	}
+	if *depth < 1 || *depth > 2 {
+		fmt.Fprintln(os.Stderr, "The depth has to be 1 or 2.")
+		flag.Usage()
+		os.Exit(2)
+	}
+	if *minRating < 0 || *minRating > 10 {
+		fmt.Fprintln(os.Stderr, "The minimum rating has to be between 1 and 10.")
+		flag.Usage()
+		os.Exit(2)
+	}
+	if *minAvg < 0 || *minAvg > 10 {
+		fmt.Fprintln(os.Stderr, "The minimum average has to be between 1 and 10.")
+		flag.Usage()
+		os.Exit(2)
+	}
+	if *minVotes < 0 {
+		fmt.Fprintln(os.Stderr, "The minimum votes can't be negative.")
+		flag.Usage()
+		os.Exit(2)
+	}
+	sinceDate, err := parseDate(*since)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid date \"%s\", use YYYY-MM-DD.\n", *since)
+		flag.Usage()
+		os.Exit(2)
+	}
+	untilDate, err := parseDate(*until)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid date \"%s\", use YYYY-MM-DD.\n", *until)
+		flag.Usage()
+		os.Exit(2)
+	}
+	if !sinceDate.IsZero() && !untilDate.IsZero() && sinceDate.After(untilDate) {
+		fmt.Fprintln(os.Stderr, "The -since date has to be before the -until date.")
+		flag.Usage()
+		os.Exit(2)
+	}
+	if *compare != "" && len(letterboxd.Dedupe(splitList(*compare))) != 2 {
+		fmt.Fprintln(os.Stderr, "Exactly two different users can be compared.")
+		flag.Usage()
+		os.Exit(2)
+	}
+	if *minPopularity < 0 {
+		fmt.Fprintln(os.Stderr, "The minimum popularity can't be negative.")
+		flag.Usage()
+		os.Exit(2)
+	}
+	if *minRuntime < 0 || *maxRuntime < 0 {
+		fmt.Fprintln(os.Stderr, "The runtime limits can't be negative.")
+		flag.Usage()
+		os.Exit(2)
+	}
+	if *minRuntime > 0 && *maxRuntime > 0 && *minRuntime > *maxRuntime {
+		fmt.Fprintln(os.Stderr, "The -min-runtime has to be at most the -max-runtime.")
+		flag.Usage()
+		os.Exit(2)
+	}
+	if *pagesPerSecond <= 0 {
+		fmt.Fprintln(os.Stderr, "The pages per second have to be positive.")
+		flag.Usage()
+		os.Exit(2)
+	}
+	if *deadline < 0 {
+		fmt.Fprintln(os.Stderr, "The deadline can't be negative.")
+		flag.Usage()
+		os.Exit(2)
+	}
+	if *minFriends < 0 {
+		fmt.Fprintln(os.Stderr, "The minimum number of friends can't be negative.")
+		flag.Usage()
+		os.Exit(2)
+	}
+	if *minEnrichVotes < 0 {
+		fmt.Fprintln(os.Stderr, "The minimum votes to fetch the details can't be negative.")
+		flag.Usage()
+		os.Exit(2)
+	}
+	if *top <= 0 {
+		fmt.Fprintln(os.Stderr, "The number of printed movies has to be positive.")
+		flag.Usage()
+		os.Exit(2)
+	}
+	var tmpl *texttemplate.Template
+	if *lineTemplate != "" {
+		var err error
+		tmpl, err = parseLineTemplate(*lineTemplate)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid -line-template: %v\n", err)
+			flag.Usage()
+			os.Exit(2)
+		}
+	}
+
+	if (*minYear > 0 || *maxYear > 0 || *genres != "" || *minRuntime > 0 || *maxRuntime > 0 || *minPopularity > 0) && !*metadata {
+		fmt.Fprintln(os.Stderr, "Filtering by year, genre, runtime or popularity needs the movie metadata, -metadata=false is ignored.")
+		*metadata = true
+	}
+	// The key isn't the flag's default so -help doesn't print it
+	if *tmdbKey == "" {
+		*tmdbKey = os.Getenv("TMDB_API_KEY")
+	}
+	if *tmdbKey != "" && !*metadata {
+		fmt.Fprintln(os.Stderr, "The TMDB details need the movie metadata, -tmdb-key is ignored.")
+		*tmdbKey = ""
+	}
+
+	if *quiet {
+		logger.SetLevel(letterboxd.LevelWarn)
+	} else if *verbose {
+		logger.SetLevel(letterboxd.LevelDebug)
+	}
+	if *logLevel != "" {
+		level, ok := levelNames[strings.ToLower(strings.TrimSpace(*logLevel))]
+		if !ok {
+			fmt.Fprintf(os.Stderr, "Unknown log level \"%s\", use error, warn, info or debug.\n", *logLevel)
+			flag.Usage()
+			os.Exit(2)
+		}
+		logger.SetLevel(level)
+	}
+	logger.SetJSON(*logJSON)
+	// JSON Lines without an output file go to stdout, so everything
+	// else has to go to stderr
+	if *format == "jsonl" && strings.TrimSpace(*output) == "" && !interactive && !*saveAll {
+		*output = "-"
+		logger.SetOutput(os.Stderr, os.Stderr)
+	}
+	if *noColor {
+		useColor = false
+	}
+
+	lb := &Letterboxd{
+		Users:          letterboxd.Dedupe(splitList(*user)),
+		Network:        *network,
+		Depth:          *depth,
+		ExcludeWatched: *excludeWatched,
+		Threshold:      *threshold,
+		Output:         strings.TrimSpace(*output),
+		SaveAll:        *saveAll,
+		Format:         *format,
+		SortBy:         *sortBy,
+		SaveRaw:        *saveRaw,
+		Histogram:      strings.TrimSpace(*histogram),
+		LoadRaw:        *loadRaw,
+		SinceRun:       strings.TrimSpace(*sinceRun),
+		Top:            *top,
+		MinFriends:     *minFriends,
+		SkipEmpty:      *skipEmpty,
+		Deadline:       *deadline,
+		LineTemplate:   tmpl,
+		ExcludeFile:    *excludeFile,
+		FriendsFile:    strings.TrimSpace(*friendsFile),
+		SaveFriends:    strings.TrimSpace(*saveFriends),
+		FriendsReport:  strings.TrimSpace(*friendsReport),
+		List:           strings.TrimSpace(*list),
+		Similarity:     *similarity,
+		ShowMine:       *showMine,
+		ShowRaters:     *showRaters,
+		Metadata:       *metadata,
+		MinEnrichVotes: *minEnrichVotes,
+		MetaCache:      strings.TrimSpace(*metaCacheFile),
+		TMDBKey:        strings.TrimSpace(*tmdbKey),
+		MinYear:        *minYear,
+		MaxYear:        *maxYear,
+		MinRuntime:     *minRuntime,
+		MaxRuntime:     *maxRuntime,
+		MinPopularity:  *minPopularity,
+		DryRun:         *dryRun,
+		MaxPerFriend:   *maxPerFriend,
+		MinRating:      *minRating,
+		MinAvg:         *minAvg,
+		MinLoved:       *minLoved,
+		MinVotes:       *minVotes,
+		Since:          sinceDate,
+		Until:          untilDate,
+		WarnMovies:     *warnMovies,
+		PagesPerSecond: *pagesPerSecond,
+		Yes:            *yes,
+		Interactive:    interactive,
+	}
+	if *friends != "" {
+		lb.Friends = splitList(*friends)
+	}
+	if *compare != "" {
+		lb.Compare = splitList(*compare)
+	}
+	for _, genre := range strings.Split(*genres, ",") {
+		if genre = strings.TrimSpace(genre); genre != "" {
+			lb.Genres = append(lb.Genres, genre)
+		}
+	}
+	// The own ratings, e.g. for -similarity, are the first user's
+	if len(lb.Users) > 0 {
+		lb.User = lb.Users[0]
+	}
+
+	return lb, set
+}
+
+// recommendDefaults are the settings of -recommend
+var recommendDefaults = map[string]string{
+	"exclude-watched": "true",
+	"threshold":       "2",
+	"min-avg":         "8",
+}
 
-		fmt.Println("Connection problem, retrying in 1s")
-		time.Sleep(time.Second)
+// parseDate parses a YYYY-MM-DD date, an empty string is the zero time
+func parseDate(value string) (time.Time, error) {
+	if value = strings.TrimSpace(value); value == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse("2006-01-02", value)
+}
+
+// defaultConfigPath returns ~/.letterboxd-friends.toml
+func defaultConfigPath() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ".letterboxd-friends.toml"
+	}
+	return filepath.Join(home, ".letterboxd-friends.toml")
+}
+
+// loadConfig reads a config file. Its keys are the flag names and it
+// uses a flat subset of TOML:
+//
+//	user = "me"
+//	friends = ["user1", "user2"]
+//	exclude-watched = true
+//	threshold = 2
+//	timeout = "20s"
+//
+// Arrays are joined with commas, like the flags expect them.
+func loadConfig(filename string) (map[string]string, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
 	}
+	defer file.Close()
+
+	settings := make(map[string]string)
+	scanner := bufio.NewScanner(file)
+	for nr := 1; scanner.Scan(); nr++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
 
-	return nil, fmt.Errorf("no connection available")
+		key, value, found := strings.Cut(line, "=")
+		if !found {
+			return nil, fmt.Errorf("%s:%d: expected \"key = value\"", filename, nr)
+		}
+		key = strings.Trim(strings.TrimSpace(key), `"`)
+		value, err := parseConfigValue(strings.TrimSpace(value))
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", filename, nr, err)
+		}
+		settings[key] = value
+	}
+	return settings, scanner.Err()
 }
 
-// checkUser verifies if a Letterboxd username exists
-func checkUser(username string) (string, bool) {
-	// Check if username contains only alphanumeric chars (after removing underscores)
-	usernameC := strings.ReplaceAll(username, "_", "")
-	for _, c := range usernameC {
-		if !((c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')) {
-			fmt.Printf("The user \"%s\" does not exist.\n", username)
-			return username, false
+// parseConfigValue parses a TOML string, array of strings, number or
+// boolean into the form the flag package expects
+func parseConfigValue(value string) (string, error) {
+	// Drop a trailing comment outside of strings, a backslash only
+	// escapes the quote in basic "..." strings, not in literal '...' ones
+	var quote rune
+	for i, c := range value {
+		if quote == 0 && (c == '"' || c == '\'') {
+			quote = c
+		} else if c == quote && (quote == '\'' || value[i-1] != '\\') {
+			quote = 0
+		} else if c == '#' && quote == 0 {
+			value = strings.TrimSpace(value[:i])
+			break
 		}
 	}
 
-	// Check if the user exists on Letterboxd
-	url := "https://letterboxd.com/" + username
-	doc, err := getPage(url)
-	if err != nil || doc == nil {
-		fmt.Printf("The user \"%s\" does not exist.\n", username)
-		return username, false
+	switch {
+	case strings.HasPrefix(value, "["):
+		if !strings.HasSuffix(value, "]") {
+			return "", fmt.Errorf("arrays have to be on one line")
+		}
+		var items []string
+		for _, item := range strings.Split(strings.TrimSuffix(strings.TrimPrefix(value, "["), "]"), ",") {
+			if item = strings.TrimSpace(item); item == "" {
+				continue
+			}
+			parsed, err := parseConfigValue(item)
+			if err != nil {
+				return "", err
+			}
+			items = append(items, parsed)
+		}
+		return strings.Join(items, ","), nil
+	case strings.HasPrefix(value, `"`):
+		return strconv.Unquote(value)
+	case strings.HasPrefix(value, "'"):
+		if len(value) < 2 || !strings.HasSuffix(value, "'") {
+			return "", fmt.Errorf("unterminated string %s", value)
+		}
+		return value[1 : len(value)-1], nil
+	case value == "":
+		return "", fmt.Errorf("missing value")
 	}
+	return value, nil
+}
 
-	// Check if the page has the expected structure
-	header := doc.Find("body header section")
-	if header.Length() == 0 {
-		fmt.Printf("The user \"%s\" does not exist.\n", username)
-		return username, false
+// splitList splits a comma separated list and drops empty entries
+func splitList(input string) []string {
+	var list []string
+	for _, item := range strings.Split(strings.ReplaceAll(input, " ", ""), ",") {
+		if item != "" {
+			list = append(list, item)
+		}
 	}
+	return list
+}
 
-	return username, true
+// levelNames maps the names accepted by -log-level to the Levels
+var levelNames = map[string]letterboxd.Level{
+	"error": letterboxd.LevelError,
+	"warn":  letterboxd.LevelWarn,
+	"info":  letterboxd.LevelInfo,
+	"debug": letterboxd.LevelDebug,
 }
 
 // getUser prompts for and validates a username
-func getUser() string {
+func getUser(ctx context.Context) string {
 	reader := bufio.NewReader(os.Stdin)
 
 	for {
@@ -145,44 +647,42 @@ func getUser() string {
 			continue
 		}
 
-		if validUser, ok := checkUser(user); ok {
-			return validUser
+		ok, err := letterboxd.CheckUser(ctx, user)
+		if ok {
+			return user
 		}
 
-		fmt.Println("\nThis user does not exist!")
+		fmt.Printf("\n%s\n", letterboxd.UserMessage(user, err))
 	}
 }
 
-// findFollowing gets all users the given user is following
-func findFollowing(user string) []string {
-	following := []string{}
-	url := "https://letterboxd.com/" + user + "/following/"
+// askNetwork asks which network the friends list is generated from
+func askNetwork() string {
+	reader := bufio.NewReader(os.Stdin)
+	choices := []string{"following", "followers", "mutuals", "union"}
 
 	for {
-		doc, err := getPage(url)
-		if err != nil || doc == nil {
-			break
+		fmt.Println("\nWhich users should be included?")
+		for i, choice := range choices {
+			fmt.Printf("\t%d: %s\n", i+1, letterboxd.Networks[choice])
 		}
+		fmt.Print("Enter a number, or just press Enter for the users you follow.\n")
 
-		doc.Find("td.table-person").Each(func(_ int, s *goquery.Selection) {
-			if href, exists := s.Find("h3 a").Attr("href"); exists {
-				userURL := strings.ReplaceAll(href, "/", "")
-				following = append(following, userURL)
-			}
-		})
-
-		nextLink, exists := doc.Find("div.pagination a.next").Attr("href")
-		if !exists {
-			break
+		input, _ := reader.ReadString('\n')
+		input = strings.TrimSpace(input)
+		if input == "" {
+			return choices[0]
 		}
-		url = "https://letterboxd.com" + nextLink
+		if nr, err := strconv.Atoi(input); err == nil && nr >= 1 && nr <= len(choices) {
+			return choices[nr-1]
+		}
+		fmt.Printf("Please enter a number between 1 and %d.\n", len(choices))
 	}
-
-	return following
 }
 
-// getFriends prompts for friends or gets them from following list
-func getFriends(user string) []string {
+// getFriends prompts for friends or gets them from the given network,
+// asking for the network if none is given
+func getFriends(ctx context.Context, users []string, network string) []string {
 	reader := bufio.NewReader(os.Stdin)
 
 	for {
@@ -192,22 +692,40 @@ func getFriends(user string) []string {
 
 		input, _ := reader.ReadString('\n')
 		input = strings.TrimSpace(input)
+		if input == "x" {
+			fmt.Print("\n --------------------------------END--------------------------------\n\n")
+			exit(0)
+		}
 
 		var friends []string
 		if input == "" {
-			fmt.Println("The friends list is generated...")
-			friends = findFollowing(user)
-		} else {
-			fmt.Println("\nThe given users are checked...")
-			for _, friend := range strings.Split(strings.ReplaceAll(input, " ", ""), ",") {
-				if validFriend, ok := checkUser(friend); ok {
-					friends = append(friends, validFriend)
+			if network == "" {
+				network = askNetwork()
+			}
+			logger.Infof("The friends list is generated...\n")
+			var err error
+			friends, err = letterboxd.FindNetworks(ctx, users, network)
+			for err != nil {
+				fmt.Printf("\nThe friends list may be incomplete, %d users were found (%v).\n", len(friends), err)
+				if !askYesNo("Do you want to try again (y/n)?") {
+					break
 				}
+				logger.Infof("The friends list is generated...\n")
+				friends, err = letterboxd.FindNetworks(ctx, users, network)
+			}
+			if len(friends) == 0 && err == nil {
+				// An empty network is no fetching problem, trying again won't help
+				fmt.Printf("\nNobody was found among %s.\n", letterboxd.Networks[network])
+				fmt.Println("Enter some users by hand, or type \"x\" to quit.")
+				continue
 			}
+		} else {
+			logger.Infof("\nThe given users are checked...\n")
+			friends = letterboxd.CheckFriends(ctx, letterboxd.WithoutUsers(letterboxd.Dedupe(splitList(input)), users...))
 		}
 
 		if len(friends) == 0 {
-			fmt.Println("\nNo user was found!")
+			fmt.Println("\nNo user was found! Try again, or type \"x\" to quit.")
 			continue
 		}
 
@@ -215,48 +733,71 @@ func getFriends(user string) []string {
 	}
 }
 
-// getMovieCount gets the number of rated movies for each friend
-func getMovieCount(friends []string) []int {
-	fmt.Println("\nThe number of rated movies is collected...")
-	movieCount := make([]int, len(friends))
+// addMoreFriends warns when fewer than minFriends friends are used, as the
+// averages then only tell the taste of one or two people. Users can be
+// added until there are enough, or Enter continues anyway.
+func addMoreFriends(ctx context.Context, users []string, friends []string, minFriends int) []string {
+	reader := bufio.NewReader(os.Stdin)
 
-	for i, friend := range friends {
-		url := "https://letterboxd.com/" + friend + "/films/rated/.5-5/"
-		doc, err := getPage(url)
-		if err != nil || doc == nil {
-			continue
-		}
+	for len(friends) < minFriends {
+		fmt.Printf("\nOnly %d friend(s) are used, the averages are just their ratings and say little about a group.\n", len(friends))
+		fmt.Println("Add more users in the form of:")
+		fmt.Println("\t\"user1, user2, user3\"")
+		fmt.Print("Else just press Enter to continue anyway.\n")
 
-		// Try to find the count text
-		text := doc.Find("span.replace-if-you").Parent().Text()
-		parts := strings.Split(text, "has")
-		if len(parts) < 2 {
-			continue
+		input, _ := reader.ReadString('\n')
+		input = strings.TrimSpace(input)
+		if input == "" {
+			break
 		}
-
-		// Extract numbers from the text
-		var numb string
-		for _, char := range parts[1] {
-			if char >= '0' && char <= '9' {
-				numb += string(char)
-			}
+		if input == "x" {
+			fmt.Print("\n --------------------------------END--------------------------------\n\n")
+			exit(0)
 		}
 
-		if numb != "" {
-			count, _ := strconv.Atoi(numb)
-			movieCount[i] = count
-		}
+		logger.Infof("\nThe given users are checked...\n")
+		friends = letterboxd.WithoutUsers(letterboxd.Dedupe(append(friends, letterboxd.CheckFriends(ctx, letterboxd.Dedupe(splitList(input)))...)), users...)
+	}
+	return friends
+}
+
+// estimateMinutes estimates how long loading the pages takes at the
+// given pages per second, which can't be more than the rate limit
+func estimateMinutes(pages int, pagesPerSecond float64) float64 {
+	if fetcher.RateLimit > 0 {
+		pagesPerSecond = math.Min(pagesPerSecond, fetcher.RateLimit)
+	}
+	return math.Max(float64(pages)/pagesPerSecond/60, 0.1)
+}
+
+// printEstimate prints how many requests collecting the ratings of the
+// given friends needs
+func printEstimate(friends []string, movieCount []int) {
+	fmt.Println("Estimated requests per friend:")
+	for i, friend := range friends {
+		fmt.Printf("%s, %d rated movies, %d pages\n", friend, movieCount[i], letterboxd.RatedPages(movieCount[i]))
 	}
 
-	return movieCount
+	followingPages := (len(friends) + letterboxd.FriendsPerPage - 1) / letterboxd.FriendsPerPage
+	ratingPages := letterboxd.TotalPages(movieCount)
+	fmt.Printf("\n%d pages for the following list (if it is generated)\n", followingPages)
+	fmt.Printf("%d pages for the number of rated movies\n", len(friends))
+	fmt.Printf("%d pages for the ratings\n", ratingPages)
+	fmt.Printf("%d requests in total, plus one per unique movie for the metadata\n",
+		followingPages+len(friends)+ratingPages)
 }
 
 // askExcludeWatched asks if user's watched movies should be excluded
 func askExcludeWatched() bool {
+	return askYesNo("Should your watched movies be excluded from the list (y/n)?")
+}
+
+// askYesNo asks a question until it is answered with "y" or "n"
+func askYesNo(question string) bool {
 	reader := bufio.NewReader(os.Stdin)
 
 	for {
-		fmt.Print("Should your watched movies be excluded from the list (y/n)?\n")
+		fmt.Print(question + "\n")
 		exc, _ := reader.ReadString('\n')
 		exc = strings.TrimSpace(exc)
 
@@ -270,157 +811,42 @@ func askExcludeWatched() bool {
 	}
 }
 
-// getAllMovies gets all movies watched by a user
-func getAllMovies(username string) []string {
-	var movies []string
-	fmt.Printf("All of '%s's' movies are searched...\n\n", username)
-
-	url := "https://letterboxd.com/" + username + "/films/"
-	for {
-		doc, err := getPage(url)
-		if err != nil || doc == nil {
-			break
-		}
-
-		doc.Find("li.poster-container").Each(func(_ int, s *goquery.Selection) {
-			if link, exists := s.Find("div").Attr("data-target-link"); exists {
-				movies = append(movies, link)
-			}
-		})
+// enrichInterruptible runs EnrichResults until it is done or Ctrl-C is
+// pressed, leaving the remaining results without details
+func enrichInterruptible(ctx context.Context, results []letterboxd.Result, minVotes int) {
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt)
+	defer stop()
 
-		nextLink, exists := doc.Find("div.pagination a.next").Attr("href")
-		if !exists {
-			fmt.Printf("\"%s\" is finished.\n", username)
-			fmt.Printf("%d movies were found\n\n", len(movies))
-			return movies
-		}
-		url = "https://letterboxd.com" + nextLink
+	letterboxd.EnrichResults(ctx, results, minVotes)
+	if ctx.Err() != nil {
+		logger.Warnf("Collecting the details was interrupted, some movies are shown without them.\n\n")
 	}
-
-	fmt.Printf("\"%s\" is finished.\n", username)
-	fmt.Printf("%d movies were found\n\n", len(movies))
-	return movies
 }
 
-// getRatedMovies gets all rated movies by a user, excluding specified movies
-func getRatedMovies(username string, excludeMovies []string) []Movie {
-	var movies []Movie
-	fmt.Printf("All of \"%s\"s rated movies are searched...\n\n", username)
-
-	excludeMap := make(map[string]bool)
-	for _, m := range excludeMovies {
-		excludeMap[m] = true
-	}
-
-	url := "https://letterboxd.com/" + username + "/films/by/member-rating/"
-	for {
-		doc, err := getPage(url)
-		if err != nil || doc == nil {
-			break
-		}
-
-		moviesOnPage := false
-		doc.Find("li.poster-container").Each(func(_ int, s *goquery.Selection) {
-			newTitle, exists := s.Find("div").Attr("data-target-link")
-			if !exists {
-				return
-			}
-
-			ratingElem := s.Find("p span.rating")
-			if ratingElem.Length() == 0 {
-				return
-			}
-
-			moviesOnPage = true
-			ratingClass, exists := ratingElem.Attr("class")
-			if !exists {
-				return
-			}
-
-			parts := strings.Split(ratingClass, " ")
-			ratingStr := strings.ReplaceAll(parts[len(parts)-1], "rated-", "")
-			rating, err := strconv.Atoi(ratingStr)
-			if err != nil {
-				return
-			}
-
-			if !excludeMap[newTitle] {
-				movies = append(movies, Movie{URL: newTitle, Rating: rating})
-			}
-		})
-
-		if !moviesOnPage {
-			fmt.Printf("\"%s\" is finished.\n", username)
-			fmt.Printf("%d movies were found\n\n", len(movies))
-			return movies
-		}
-
-		nextLink, exists := doc.Find("div.pagination a.next").Attr("href")
-		if !exists {
-			fmt.Printf("\"%s\" is finished.\n", username)
-			fmt.Printf("%d movies were found\n\n", len(movies))
-			return movies
-		}
-		url = "https://letterboxd.com" + nextLink
+// yearString formats a release year, leaving unknown years empty
+func yearString(year int) string {
+	if year == 0 {
+		return ""
 	}
-
-	fmt.Printf("\"%s\" is finished.\n", username)
-	fmt.Printf("%d movies were found\n\n", len(movies))
-	return movies
+	return strconv.Itoa(year)
 }
 
-// mergeMovies combines all movie ratings from different users
-func mergeMovies(movies []Movie) []MovieWithRatings {
-	// Sort by URL for easier grouping
-	sort.Slice(movies, func(i, j int) bool {
-		return movies[i].URL < movies[j].URL
-	})
-
-	var uniqueMovies []MovieWithRatings
-	i := 0
-	for i < len(movies) {
-		movie := movies[i]
-		ratings := []int{movie.Rating}
-
-		j := i + 1
-		for j < len(movies) && movies[j].URL == movie.URL {
-			ratings = append(ratings, movies[j].Rating)
-			j++
+// checkNumber validates the threshold input. A fraction, e.g. "0.5", is
+// the share of the friends who have to have rated a movie, rounded up.
+func checkNumber(thresholdStr string, friendsNr int) (int, bool) {
+	if strings.Contains(thresholdStr, ".") {
+		fraction, err := strconv.ParseFloat(thresholdStr, 64)
+		if err != nil || fraction <= 0 || fraction > 1 {
+			fmt.Println("Please enter a fraction between 0 and 1, e.g. 0.5 for half of your friends.")
+			return 0, false
 		}
-
-		uniqueMovies = append(uniqueMovies, MovieWithRatings{
-			URL:     movie.URL,
-			Ratings: ratings,
-		})
-
-		i = j
-	}
-
-	return uniqueMovies
-}
-
-// processResults processes the merged movies data
-func processResults(uniqueMovies []MovieWithRatings) []Result {
-	var results []Result
-
-	for _, movie := range uniqueMovies {
-		avgRating := avg(movie.Ratings)
-		results = append(results, Result{
-			AvgRating: avgRating,
-			VoteCount: len(movie.Ratings),
-				 URL:       movie.URL,
-				 Ratings:   movie.Ratings,
-		})
+		// Allow for rounding errors like 0.3 * 10 = 3.0000000000000004
+		return max(1, int(math.Ceil(fraction*float64(friendsNr)-1e-9))), true
 	}
 
-	return results
-}
-
-// checkNumber validates the threshold input
-func checkNumber(thresholdStr string, friendsNr int) (int, bool) {
 	threshold, err := strconv.Atoi(thresholdStr)
 	if err != nil {
-		fmt.Println("Please enter a whole number.")
+		fmt.Println("Please enter a whole number, or a fraction like 0.5 for half of your friends.")
 		return 0, false
 	}
 
@@ -433,17 +859,24 @@ func checkNumber(thresholdStr string, friendsNr int) (int, bool) {
 }
 
 // showResults displays and handles results
-func showResults(moviesList []Result, friendsNr int) {
+func showResults(ctx context.Context, moviesList []letterboxd.Result, lb *Letterboxd) {
 	reader := bufio.NewReader(os.Stdin)
-	threshold := 0
+	friendsNr := len(lb.Friends)
+	top := lb.Top
+	if top <= 0 {
+		top = 15
+	}
+
+	threshold := shownThreshold(lb)
 
 	for {
-		fmt.Println("Minimum number of ratings per movie? (You can changes this later)")
+		if threshold == 0 {
+			fmt.Println("Minimum number of ratings per movie? (You can changes this later)")
+		}
 
-		var thresholdStr string
 		for threshold == 0 {
-			fmt.Printf("Enter a number between 1 and %d.\n", friendsNr)
-			thresholdStr, _ = reader.ReadString('\n')
+			fmt.Printf("Enter a number between 1 and %d, or a fraction like 0.5 for half of your friends.\n", friendsNr)
+			thresholdStr, _ := reader.ReadString('\n')
 			thresholdStr = strings.TrimSpace(thresholdStr)
 
 			var valid bool
@@ -453,224 +886,1448 @@ func showResults(moviesList []Result, friendsNr int) {
 			}
 		}
 
-		// Filter movies by threshold
-		var moviesFiltered []Result
+		// The details of the movies that newly reach the threshold are
+		// fetched only now
+		var enriched bool
+		if moviesList, enriched = enrichFrom(ctx, moviesList, lb, threshold); enriched && lb.TMDBKey != "" {
+			letterboxd.AddTMDB(ctx, moviesList, letterboxd.NewTMDB(lb.TMDBKey))
+		}
+
+		// Filter movies by threshold and the other filters
+		var moviesFiltered []letterboxd.Result
 		for _, movie := range moviesList {
-			if movie.VoteCount >= threshold {
+			if movie.VoteCount >= threshold && matchesFilters(movie, lb) {
 				moviesFiltered = append(moviesFiltered, movie)
 			}
 		}
 
-		// Sort movies by average rating and vote count
-		sort.Slice(moviesFiltered, func(i, j int) bool {
-			if moviesFiltered[i].AvgRating != moviesFiltered[j].AvgRating {
-				return moviesFiltered[i].AvgRating > moviesFiltered[j].AvgRating
-			}
-			return moviesFiltered[i].VoteCount > moviesFiltered[j].VoteCount
-		})
+		letterboxd.SortResults(moviesFiltered, lb.SortBy)
 
 		moviesNr := len(moviesFiltered)
-		fmt.Printf("\n\n%d movies have at least %d Vote(s)\n", moviesNr, threshold)
-		fmt.Printf("Here are the top %d movie(s), sorted by average rating and number of votes.\n\n",
-			   min(moviesNr, 15))
+		if lb.Output == "-" {
+			// stdout only gets the saved results
+			saveResults(moviesFiltered, threshold, lb.SortBy, lb.Output, lb.Format)
+			return
+		}
+		fmt.Printf("\n\n%d movies have at least %d Vote(s)%s\n", moviesNr, threshold, describeFilters(lb))
+		if len(lb.Skipped) > 0 {
+			fmt.Printf("%d friend(s) were skipped as their pages couldn't be loaded or require signing in: %s\n", len(lb.Skipped), strings.Join(lb.Skipped, ", "))
+		}
+		if lb.Truncated {
+			fmt.Printf("The run reached its deadline of %s, so only the ratings collected until then are included.\n", lb.Deadline)
+		}
+		fmt.Printf("Here are the top %d movie(s), sorted by %s and number of votes.\n\n",
+			min(moviesNr, top), letterboxd.SortMetrics[lb.SortBy])
+
+		shown := moviesFiltered[:min(moviesNr, top)]
+		if lb.LineTemplate != nil {
+			printTemplate(shown, lb.LineTemplate, lb.Interactive)
+		} else {
+			printTable(shown, lb.ShowMine, lb.ShowRaters, lb.Interactive)
+		}
+		fmt.Print("\n\n\n")
 
-		fmt.Println("Avg\t Nr V, Titel,\t\t Individual Votes")
-		for i := 0; i < min(moviesNr, 15); i++ {
-			movie := moviesFiltered[i]
-			movieName := strings.ReplaceAll(strings.ReplaceAll(movie.URL, "/film/", ""), "/", "")
-			fmt.Printf("%.2f\t%d\t%s, %v\n", movie.AvgRating, movie.VoteCount, movieName, movie.Ratings)
+		if !lb.Interactive {
+			if lb.SaveAll {
+				saveAllResults(moviesFiltered, threshold, lb.Output, lb.Format)
+			} else if lb.Output != "" {
+				saveResults(moviesFiltered, threshold, lb.SortBy, lb.Output, lb.Format)
+			}
+			return
 		}
-		fmt.Println("\n\n")
 
-		fmt.Println("If you want to change the rating number, enter a new number.")
+		fmt.Println("If you want to change the rating number, enter a new number or a fraction of your friends.")
+		fmt.Println("To rank the list differently, write \"sort\" and a metric, e.g. \"sort avg\".")
+		fmt.Println("To look at a movie on Letterboxd, write \"open\" and its number, e.g. \"open 1\".")
 		fmt.Print("If you want to save the complete results write \"s\", if you want to end without saving press \"x\".\n")
 		question, _ := reader.ReadString('\n')
 		question = strings.TrimSpace(question)
 
-		if question == "x" {
+		if metric, ok := strings.CutPrefix(question, "sort"); ok {
+			metric = strings.ToLower(strings.TrimSpace(metric))
+			if _, known := letterboxd.SortMetrics[metric]; known {
+				lb.SortBy = metric
+			} else {
+				fmt.Printf("Unknown metric \"%s\", use one of: %s.\n", metric, strings.Join(metricNames(), ", "))
+			}
+		} else if row, ok := strings.CutPrefix(question, "open"); ok {
+			nr, err := strconv.Atoi(strings.TrimSpace(row))
+			if err != nil || nr < 1 || nr > len(shown) {
+				fmt.Printf("Enter the number of one of the %d movies shown, e.g. \"open 1\".\n", len(shown))
+			} else if err := openBrowser(filmURL(shown[nr-1].URL)); err != nil {
+				logger.Errorf("Error opening %s: %v\n", filmURL(shown[nr-1].URL), err)
+			}
+		} else if question == "x" {
 			fmt.Print("Are you sure you want to end without saving (y/n)?")
 			r, _ := reader.ReadString('\n')
 			r = strings.TrimSpace(r)
 			if r == "y" {
-				fmt.Println("\n --------------------------------END--------------------------------\n")
+				fmt.Print("\n --------------------------------END--------------------------------\n\n")
 				return
 			}
 		} else if question == "s" {
-			saveResults(moviesFiltered, threshold)
+			if lb.SaveAll {
+				saveAllResults(moviesFiltered, threshold, lb.Output, lb.Format)
+			} else {
+				saveResults(moviesFiltered, threshold, lb.SortBy, lb.Output, lb.Format)
+			}
 			return
+		} else if nr, valid := checkNumber(question, friendsNr); valid && nr >= 1 {
+			threshold = nr
 		} else {
 			threshold = 0
-			thresholdStr = question
 		}
 	}
 }
 
-// saveResults saves the results to a CSV file
-func saveResults(data []Result, threshold int) {
-	reader := bufio.NewReader(os.Stdin)
-
-	fmt.Println("If you want to specifiy the dir and filename, enter it here.")
-	fmt.Print("Else it will be saved as \"results.csv\" in the current dir\n")
-	filename, _ := reader.ReadString('\n')
-	filename = strings.TrimSpace(filename)
-
-	if filename == "" {
-		filename = "results.csv"
+// shownThreshold returns the minimum number of votes the shown movies
+// start with, 0 if it is asked for first
+func shownThreshold(lb *Letterboxd) int {
+	friendsNr := len(lb.Friends)
+	if !lb.Interactive {
+		return max(1, min(lb.Threshold, friendsNr))
 	}
-
-	file, err := os.Create(filename)
-	if err != nil {
-		fmt.Println("Error creating file:", err)
-		return
+	if lb.Threshold < 0 || lb.Threshold > friendsNr {
+		return 0
 	}
-	defer file.Close()
-
-	writer := csv.NewWriter(file)
-	defer writer.Flush()
+	return lb.Threshold
+}
 
-	writer.Write([]string{fmt.Sprintf("Movies with at least %d Votes, ranked by Avg and No. Votes.", threshold)})
-	writer.Write([]string{"Avg Rating, No Votes, Movie, List of Votes"})
+// enrichFrom fetches the details of the movies with at least
+// -min-votes-to-enrich votes, or the threshold if it isn't set, unless
+// they were fetched from as few votes before. The movies the details show
+// to be the same film are merged, so the results are returned again, and
+// whether the details were fetched.
+func enrichFrom(ctx context.Context, results []letterboxd.Result, lb *Letterboxd, threshold int) ([]letterboxd.Result, bool) {
+	if !lb.Metadata {
+		return results, false
+	}
+	votes := threshold
+	if lb.MinEnrichVotes > 0 {
+		votes = lb.MinEnrichVotes
+	}
+	if lb.EnrichedFrom > 0 && votes >= lb.EnrichedFrom {
+		return results, false
+	}
+	enrichInterruptible(ctx, results, votes)
+	lb.EnrichedFrom = votes
+	return letterboxd.MergeCanonical(results, lb.Merged, lb.MovieCounts, lb.MinVotes, lb.Similarities), true
+}
 
-	for _, row := range data {
-		// Convert ratings to strings
-		ratings := make([]string, len(row.Ratings))
-		for i, r := range row.Ratings {
-			ratings[i] = strconv.Itoa(r)
+// printTable prints the results with all metrics, one movie per line.
+// Numbered rows start with their rank, e.g. to open them.
+func printTable(results []letterboxd.Result, showMine bool, showRaters bool, numbered bool) {
+	if numbered {
+		fmt.Print("#\t")
+	}
+	if showMine {
+		fmt.Print("Me\t")
+	}
+	fmt.Println("Bayes\t Avg\t Med\t Mode\t Wght\t RMS\t CAvg\t Ctrv\t Lvd\t Nr V, Titel,\t\t Individual Votes")
+	for i, movie := range results {
+		if numbered {
+			fmt.Printf("%d\t", i+1)
+		}
+		if showMine {
+			fmt.Print(myRatingString(movie.MyRating) + "\t")
+		}
+		votes := fmt.Sprint(letterboxd.StarList(movie.Ratings))
+		if showRaters {
+			votes = voteList(movie)
 		}
+		fmt.Printf("%s\t%s\t%.2f\t%.1f\t%.1f\t%.2f\t%.2f\t%.2f\t%d\t%d\t%s, %s\n",
+			colorRating(movie.BayesianRating, fmt.Sprintf("%.2f", letterboxd.Stars(movie.BayesianRating))),
+			colorRating(movie.AvgRating, fmt.Sprintf("%.2f", letterboxd.Stars(movie.AvgRating))), letterboxd.Stars(movie.Median),
+			letterboxd.Stars(float64(movie.Mode)), movie.WeightedRating, letterboxd.Stars(movie.RMSRating), letterboxd.Stars(movie.WeightedAvg),
+			letterboxd.Stars(movie.Controversy), movie.LovedBy, movie.VoteCount, movieName(movie), votes)
+	}
+}
 
-		writer.Write([]string{
-			fmt.Sprintf("%.3f", row.AvgRating),
-			     strconv.Itoa(row.VoteCount),
-			     row.URL,
-			     strings.Join(ratings, ", "),
-		})
+// voteList lists the votes of a movie with the friends who gave them, e.g.
+// "alice 4.5, bob 3". Results loaded from older files may lack the raters.
+func voteList(r letterboxd.Result) string {
+	votes := make([]string, len(r.Ratings))
+	for i, rating := range letterboxd.StarList(r.Ratings) {
+		votes[i] = strconv.FormatFloat(rating, 'f', -1, 64)
+		if i < len(r.Raters) {
+			votes[i] = r.Raters[i] + " " + votes[i]
+		}
 	}
+	return strings.Join(votes, ", ")
+}
 
-	fmt.Println("List is saved")
+// printTemplate prints every result formatted with a -line-template,
+// numbered lines start with their rank
+func printTemplate(results []letterboxd.Result, tmpl *texttemplate.Template, numbered bool) {
+	for i, movie := range results {
+		if numbered {
+			fmt.Printf("%d. ", i+1)
+		}
+		if err := tmpl.Execute(os.Stdout, movie); err != nil {
+			logger.Errorf("Error formatting \"%s\": %v\n", movieName(movie), err)
+			return
+		}
+		fmt.Println()
+	}
 }
 
-// collectMoviesParallel collects movies from multiple users in parallel
-func collectMoviesParallel(friends []string, excludeMovies []string) []Movie {
-	var wg sync.WaitGroup
-	moviesChan := make(chan []Movie, len(friends))
+// lineFuncs are the functions a -line-template can use besides the
+// built-in ones, ratings are stored on a 1-10 scale
+var lineFuncs = texttemplate.FuncMap{
+	"stars": func(rating float64) string { return strconv.FormatFloat(letterboxd.Stars(rating), 'f', 2, 64) },
+	"name":  movieName,
+}
 
-	// Calculate number of workers
-	numWorkers := (len(friends) / 3) + 1
-	if numWorkers > 12 {
-		numWorkers = 12
+// parseLineTemplate parses a -line-template and runs it once on an example
+// result, so unknown fields are reported at startup
+func parseLineTemplate(text string) (*texttemplate.Template, error) {
+	tmpl, err := texttemplate.New("line").Funcs(lineFuncs).Parse(text)
+	if err != nil {
+		return nil, err
 	}
-	if numWorkers < 2 {
-		numWorkers = len(friends)
+	example := letterboxd.Result{URL: "/film/example/", Ratings: []int{10}, Genres: []string{"Drama"}}
+	if err := tmpl.Execute(io.Discard, example); err != nil {
+		return nil, err
 	}
+	return tmpl, nil
+}
 
-	// Create a semaphore to limit concurrent requests
-	semaphore := make(chan struct{}, numWorkers)
-
-	for _, friend := range friends {
-		wg.Add(1)
-		go func(username string) {
-			defer wg.Done()
-
-			// Acquire semaphore
-			semaphore <- struct{}{}
-			defer func() { <-semaphore }()
-
-			movies := getRatedMovies(username, excludeMovies)
-			moviesChan <- movies
-		}(friend)
+// saveAllResults saves the results once per sort metric. The metric is
+// added to the filename, results.csv becomes results-avg.csv etc.
+func saveAllResults(data []letterboxd.Result, threshold int, filename string, format string) {
+	if filename == "" {
+		filename = "results.csv"
 	}
-
-	// Wait for all goroutines to complete then close the channel
-	go func() {
-		wg.Wait()
-		close(moviesChan)
-	}()
-
-	// Collect all movies
-	var allMovies []Movie
-	for movies := range moviesChan {
-		allMovies = append(allMovies, movies...)
+	if format == "" {
+		format = strings.TrimPrefix(strings.ToLower(filepath.Ext(filename)), ".")
 	}
+	ext := filepath.Ext(filename)
+	base := strings.TrimSuffix(filename, ext)
 
-	return allMovies
+	sorted := append([]letterboxd.Result(nil), data...)
+	for _, metric := range metricNames() {
+		letterboxd.SortResults(sorted, metric)
+		saveResults(sorted, threshold, metric, base+"-"+metric+ext, format)
+	}
 }
 
-func main() {
-	// Get user and friends
-	user := getUser()
-	friends := getFriends(user)
-	movieCount := getMovieCount(friends)
+// datedFilename returns the name the results of a run started at the
+// given time are saved to in dir, with the extension of the format. The
+// time of day keeps several runs on one day apart.
+func datedFilename(dir string, format string, started time.Time) string {
+	ext := format
+	switch format {
+	case "", "letterboxd":
+		ext = "csv"
+	}
+	return filepath.Join(dir, "results-"+started.Format("2006-01-02-150405")+"."+ext)
+}
 
-	movieSum := 0
-	for _, count := range movieCount {
-		movieSum += count
+// metricNames returns the names of all sort metrics in alphabetical order
+func metricNames() []string {
+	names := make([]string, 0, len(letterboxd.SortMetrics))
+	for name := range letterboxd.SortMetrics {
+		names = append(names, name)
 	}
-	fmt.Printf("%d movies were found.\n", movieSum)
+	sort.Strings(names)
+	return names
+}
 
-	// Sort friends by movie count
-	type FriendCount struct {
-		Friend string
-		Count  int
+// movieName returns the title and year of a movie, or a title read from
+// its slug if they are unknown
+func movieName(r letterboxd.Result) string {
+	if r.Title == "" {
+		return slugTitle(movieSlug(r.URL))
+	}
+	if r.Year == 0 {
+		return r.Title
 	}
+	return fmt.Sprintf("%s (%d)", r.Title, r.Year)
+}
+
+// movieSlug strips a "/film/<slug>/" path down to the slug
+func movieSlug(url string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(url, "/film/", ""), "/", "")
+}
 
-	combinedList := make([]FriendCount, len(friends))
-	for i := range friends {
-		combinedList[i] = FriendCount{Friend: friends[i], Count: movieCount[i]}
+// slugYear matches the year Letterboxd appends to the slugs of films
+// sharing a title, e.g. "the-thing-1982" or "the-thing-1982-1"
+var slugYear = regexp.MustCompile(`^(.+)-((?:18|19|20)\d{2})(?:-\d+)?$`)
+
+// slugTitle makes a readable title of a slug for when the title wasn't
+// fetched, e.g. "The Thing (1982)" for "the-thing-1982"
+func slugTitle(slug string) string {
+	// Numbers beyond the next years are part of the title, e.g.
+	// "blade-runner-2049"
+	year := ""
+	if match := slugYear.FindStringSubmatch(slug); match != nil {
+		if y, _ := strconv.Atoi(match[2]); y <= time.Now().Year()+2 {
+			slug, year = match[1], match[2]
+		}
 	}
 
-	sort.Slice(combinedList, func(i, j int) bool {
-		return combinedList[i].Count > combinedList[j].Count
-	})
+	var words []string
+	for _, word := range strings.Split(slug, "-") {
+		if word == "" {
+			continue
+		}
+		// "schindler-s-list" lost its apostrophe
+		if word == "s" && len(words) > 0 {
+			words[len(words)-1] += "'s"
+			continue
+		}
+		r, size := utf8.DecodeRuneInString(word)
+		words = append(words, string(unicode.ToUpper(r))+word[size:])
+	}
+	if len(words) == 0 {
+		return slug
+	}
 
-	// Update friends list to sorted order
-	friends = make([]string, len(combinedList))
-	for i, fc := range combinedList {
-		friends[i] = fc.Friend
+	title := strings.Join(words, " ")
+	if year != "" {
+		title += " (" + year + ")"
+	}
+	return title
+}
+
+// matchesFilters reports if a result passes the active filters. Movies
+// without a known year or number of ratings never pass those filters,
+// while movies without a known runtime always pass the runtime filter.
+func matchesFilters(r letterboxd.Result, lb *Letterboxd) bool {
+	if lb.MinYear > 0 || lb.MaxYear > 0 {
+		if r.Year == 0 || (lb.MinYear > 0 && r.Year < lb.MinYear) || (lb.MaxYear > 0 && r.Year > lb.MaxYear) {
+			return false
+		}
+	}
+	if len(lb.Genres) > 0 && !hasGenre(r.Genres, lb.Genres) {
+		return false
 	}
+	if r.GlobalRatings < lb.MinPopularity {
+		return false
+	}
+	if r.Runtime > 0 && ((lb.MinRuntime > 0 && r.Runtime < lb.MinRuntime) || (lb.MaxRuntime > 0 && r.Runtime > lb.MaxRuntime)) {
+		return false
+	}
+	if r.AvgRating < lb.MinAvg {
+		return false
+	}
+	if r.LovedBy < lb.MinLoved {
+		return false
+	}
+	return true
+}
+
+// useColor is whether the results are printed with ANSI colors. It is
+// off when stdout is piped or redirected, or with -no-color.
+var useColor = isTerminal(os.Stdout) && os.Getenv("NO_COLOR") == ""
 
-	fmt.Println("\n\nThese eligible users were given:")
-	for _, fc := range combinedList {
-		fmt.Printf("%s, %d rated movies\n", fc.Friend, fc.Count)
+// isTerminal reports whether the file is a terminal
+func isTerminal(file *os.File) bool {
+	info, err := file.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// colorRating colors the text of a rating on the 1-10 scale, green from
+// four stars and red below two and a half
+func colorRating(rating float64, text string) string {
+	if !useColor {
+		return text
+	}
+	switch {
+	case rating >= 8:
+		return "\033[32m" + text + "\033[0m"
+	case rating < 5:
+		return "\033[31m" + text + "\033[0m"
 	}
-	fmt.Println("\n\n")
+	return text
+}
 
-	// Check if user wants to exclude their watched movies
-	var myMovies []string
-	excludeWatched := askExcludeWatched()
-	if excludeWatched {
-		myMovies = getAllMovies(user)
-		fmt.Printf("%d movies found. These will be excluded.\n\n", len(myMovies))
-	}
-
-	// Warning for large number of movies
-	if movieSum > 3000 {
-		fmt.Printf("\n%d movies will be searched.\n", movieSum)
-		maxCount := 0
-		for _, count := range movieCount {
-			if count > maxCount {
-				maxCount = count
+// hasGenre reports if any of the wanted genres is in the list
+func hasGenre(genres []string, wanted []string) bool {
+	for _, genre := range genres {
+		for _, w := range wanted {
+			if strings.EqualFold(genre, w) {
+				return true
 			}
 		}
-		fmt.Printf("This could take a while, estimated time: %.1f min.\n", math.Max(float64(maxCount)/3000, 0.1))
+	}
+	return false
+}
+
+// describeFilters describes the active filters for the summary line
+func describeFilters(lb *Letterboxd) string {
+	var parts []string
+	switch {
+	case lb.MinYear > 0 && lb.MaxYear > 0:
+		parts = append(parts, fmt.Sprintf("were released between %d and %d", lb.MinYear, lb.MaxYear))
+	case lb.MinYear > 0:
+		parts = append(parts, fmt.Sprintf("were released in or after %d", lb.MinYear))
+	case lb.MaxYear > 0:
+		parts = append(parts, fmt.Sprintf("were released in or before %d", lb.MaxYear))
+	}
+	if len(lb.Genres) > 0 {
+		parts = append(parts, "are "+strings.Join(lb.Genres, " or "))
+	}
+	if lb.MinPopularity > 0 {
+		parts = append(parts, fmt.Sprintf("have at least %d ratings on Letterboxd", lb.MinPopularity))
+	}
+	switch {
+	case lb.MinRuntime > 0 && lb.MaxRuntime > 0:
+		parts = append(parts, fmt.Sprintf("run between %d and %d minutes", lb.MinRuntime, lb.MaxRuntime))
+	case lb.MinRuntime > 0:
+		parts = append(parts, fmt.Sprintf("run at least %d minutes", lb.MinRuntime))
+	case lb.MaxRuntime > 0:
+		parts = append(parts, fmt.Sprintf("run at most %d minutes", lb.MaxRuntime))
+	}
+	if lb.MinLoved > 0 {
+		parts = append(parts, fmt.Sprintf("were rated 4 stars or more by at least %d friend(s)", lb.MinLoved))
+	}
+	if lb.MinAvg > 0 {
+		parts = append(parts, fmt.Sprintf("have an average of at least %.1f stars", letterboxd.Stars(lb.MinAvg)))
+	}
+	switch {
+	case !lb.Since.IsZero() && !lb.Until.IsZero():
+		parts = append(parts, fmt.Sprintf("were logged between %s and %s", lb.Since.Format("2006-01-02"), lb.Until.Format("2006-01-02")))
+	case !lb.Since.IsZero():
+		parts = append(parts, fmt.Sprintf("were logged on or after %s", lb.Since.Format("2006-01-02")))
+	case !lb.Until.IsZero():
+		parts = append(parts, fmt.Sprintf("were logged on or before %s", lb.Until.Format("2006-01-02")))
+	}
+
+	if len(parts) == 0 {
+		return ""
+	}
+	return " and " + strings.Join(parts, " and ")
+}
 
+// saveResults saves the results to a file, asking for the filename if
+// none is given. The format is taken from the file extension unless it
+// is given explicitly.
+func saveResults(data []letterboxd.Result, threshold int, sortBy string, filename string, format string) {
+	if filename == "" {
 		reader := bufio.NewReader(os.Stdin)
-		fmt.Print("Do you want to start? (y/n)\n")
-		start, _ := reader.ReadString('\n')
-		start = strings.TrimSpace(start)
 
-		if !strings.Contains(start, "y") {
-			os.Exit(0)
+		fmt.Println("If you want to specifiy the dir and filename, enter it here.")
+		fmt.Print("Else it will be saved as \"results.csv\" in the current dir\n")
+		filename, _ = reader.ReadString('\n')
+		filename = strings.TrimSpace(filename)
+	}
+
+	if filename == "" {
+		filename = "results.csv"
+	}
+
+	if format == "" {
+		format = strings.TrimPrefix(strings.ToLower(filepath.Ext(filename)), ".")
+	}
+
+	file := os.Stdout
+	if filename != "-" {
+		var err error
+		file, err = os.Create(filename)
+		if err != nil {
+			logger.Errorf("Error creating file: %v\n", err)
+			return
+		}
+		defer file.Close()
+	}
+
+	var err error
+	switch format {
+	case "json":
+		err = writeJSON(file, data)
+	case "jsonl":
+		err = writeJSONL(file, data)
+	case "html":
+		err = writeHTML(file, data, threshold)
+	case "letterboxd":
+		err = writeLetterboxdList(file, data)
+	default:
+		err = writeCSV(file, data, threshold, sortBy)
+	}
+	if err != nil {
+		logger.Errorf("Error writing file: %v\n", err)
+		return
+	}
+
+	logger.Infof("List is saved\n")
+}
+
+// flushRows is the number of rows after which the CSV writers flush,
+// so huge result sets don't pile up and write errors stop the save early
+const flushRows = 1000
+
+// writeCSV writes the results as CSV
+func writeCSV(file *os.File, data []letterboxd.Result, threshold int, sortBy string) error {
+	writer := csv.NewWriter(file)
+
+	title := fmt.Sprintf("Movies with at least %d Votes, ranked by %s and No. Votes.", threshold, letterboxd.SortMetrics[sortBy])
+	if percentScale {
+		title += " Ratings from 10 (half a star) to 100 (five stars)."
+	}
+	writer.Write([]string{title})
+	writer.Write([]string{"Bayesian Rating", "Avg Rating", "Median", "Mode", "Weighted", "RMS", "Count Weighted Avg", "Controversy", "Gem Score", "Similarity Weighted Avg", "My Rating", "Loved By", "No Votes", "Movie", "Title", "Year", "Genres", "List of Votes", "Raters", "Letterboxd URL", "TMDB URL"})
+
+	for i, row := range data {
+		if i > 0 && i%flushRows == 0 {
+			writer.Flush()
+			if err := writer.Error(); err != nil {
+				return err
+			}
+		}
+
+		// Convert ratings to strings
+		ratings := make([]string, len(row.Ratings))
+		for i, r := range exportedList(row.Ratings) {
+			ratings[i] = strconv.FormatFloat(r, 'f', -1, 64)
 		}
+
+		writer.Write([]string{
+			fmt.Sprintf("%.3f", exported(row.BayesianRating)),
+			fmt.Sprintf("%.3f", exported(row.AvgRating)),
+			fmt.Sprintf("%.2f", exported(row.Median)),
+			fmt.Sprintf("%.1f", exported(float64(row.Mode))),
+			fmt.Sprintf("%.3f", row.WeightedRating),
+			fmt.Sprintf("%.3f", exported(row.RMSRating)),
+			fmt.Sprintf("%.3f", exported(row.WeightedAvg)),
+			fmt.Sprintf("%.3f", exported(row.Controversy)),
+			fmt.Sprintf("%.3f", exported(row.GemScore)),
+			fmt.Sprintf("%.3f", exported(row.SimilarAvg)),
+			exportedMyRating(row.MyRating),
+			strconv.Itoa(row.LovedBy),
+			strconv.Itoa(row.VoteCount),
+			row.URL,
+			row.Title,
+			yearString(row.Year),
+			strings.Join(row.Genres, ", "),
+			strings.Join(ratings, ", "),
+			strings.Join(row.Raters, ", "),
+			filmURL(row.URL),
+			tmdbURL(row.TMDBType, row.TMDBID),
+		})
 	}
 
-	// Collect movies in parallel
-	allMovies := collectMoviesParallel(friends, myMovies)
+	writer.Flush()
+	return writer.Error()
+}
 
-	// Merge and process movies
-	fmt.Println("All ratings are combined...")
-	uniqueMovies := mergeMovies(allMovies)
-	fmt.Printf("%d unique and rated movies are found.\n\n", len(uniqueMovies))
+// filmURL returns the full link of a "/film/<slug>/" path, the page where
+// a film can be added to the watchlist
+func filmURL(path string) string {
+	return "https://letterboxd.com" + path
+}
 
-	results := processResults(uniqueMovies)
-	showResults(results, len(friends))
+// openBrowser opens a page in the default browser without waiting for it
+func openBrowser(page string) error {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		cmd = exec.Command("open", page)
+	case "windows":
+		cmd = exec.Command("rundll32", "url.dll,FileProtocolHandler", page)
+	default:
+		cmd = exec.Command("xdg-open", page)
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	go cmd.Wait()
+	return nil
+}
+
+// tmdbURL returns the TMDB page of a movie, or of a show if kind is "tv",
+// empty if its id is unknown
+func tmdbURL(kind string, id int) string {
+	if id == 0 {
+		return ""
+	}
+	if kind != "tv" {
+		kind = "movie"
+	}
+	return fmt.Sprintf("https://www.themoviedb.org/%s/%d", kind, id)
+}
+
+// writeLetterboxdList writes the results in Letterboxd's list import
+// format, which can be uploaded at https://letterboxd.com/list/new/
+func writeLetterboxdList(file *os.File, data []letterboxd.Result) error {
+	writer := csv.NewWriter(file)
+
+	writer.Write([]string{"Position", "Title", "Year", "LetterboxdURI"})
+	for i, row := range data {
+		if i > 0 && i%flushRows == 0 {
+			writer.Flush()
+			if err := writer.Error(); err != nil {
+				return err
+			}
+		}
+
+		title := row.Title
+		if title == "" {
+			title = movieSlug(row.URL)
+		}
+		writer.Write([]string{
+			strconv.Itoa(i + 1),
+			title,
+			yearString(row.Year),
+			filmURL(row.URL),
+		})
+	}
+
+	writer.Flush()
+	return writer.Error()
+}
+
+//go:embed templates/report.html
+var templates embed.FS
+
+// reportTemplate renders the HTML report
+var reportTemplate = template.Must(template.New("report.html").Funcs(template.FuncMap{
+	"inc":        func(i int) int { return i + 1 },
+	"name":       movieName,
+	"stars":      letterboxd.Stars,
+	"starList":   letterboxd.StarList,
+	"starString": starString,
+	"votes":      voteList,
+	"filmURL":    filmURL,
+	"tmdbURL":    tmdbURL,
+}).ParseFS(templates, "templates/report.html"))
+
+// starString draws a rating on the 1-10 scale as stars, e.g. "★★★½"
+func starString(rating float64) string {
+	halves := int(math.Round(rating))
+	return strings.Repeat("★", halves/2) + strings.Repeat("½", halves%2)
+}
+
+// writeHTML writes the results as a standalone HTML report
+func writeHTML(file *os.File, data []letterboxd.Result, threshold int) error {
+	return reportTemplate.Execute(file, struct {
+		Results   []letterboxd.Result
+		Threshold int
+	}{data, threshold})
+}
+
+// jsonResult is a Result as it is written to a JSON file, with all
+// ratings in stars or, with -percent, from 10 to 100
+type jsonResult struct {
+	AvgRating      float64
+	Median         float64
+	Mode           float64
+	WeightedRating float64
+	RMSRating      float64
+	WeightedAvg    float64
+	Controversy    float64
+	GemScore       float64
+	BayesianRating float64
+	SimilarAvg     float64
+	MyRating       float64
+	LovedBy        int
+	VoteCount      int
+	URL            string
+	Slug           string
+	Title          string
+	Year           int
+	Genres         []string
+	Ratings        []float64
+	Raters         []string
+}
+
+// newJSONResult converts a Result to the saved rating scale
+func newJSONResult(row letterboxd.Result) jsonResult {
+	return jsonResult{
+		AvgRating:      exported(row.AvgRating),
+		Median:         exported(row.Median),
+		Mode:           exported(float64(row.Mode)),
+		WeightedRating: row.WeightedRating,
+		RMSRating:      exported(row.RMSRating),
+		WeightedAvg:    exported(row.WeightedAvg),
+		Controversy:    exported(row.Controversy),
+		GemScore:       exported(row.GemScore),
+		BayesianRating: exported(row.BayesianRating),
+		SimilarAvg:     exported(row.SimilarAvg),
+		MyRating:       exported(float64(row.MyRating)),
+		LovedBy:        row.LovedBy,
+		VoteCount:      row.VoteCount,
+		URL:            filmURL(row.URL),
+		Slug:           movieSlug(row.URL),
+		Title:          row.Title,
+		Year:           row.Year,
+		Genres:         row.Genres,
+		Ratings:        exportedList(row.Ratings),
+		Raters:         row.Raters,
+	}
+}
+
+// writeJSONL writes the results as JSON Lines, one object per line
+func writeJSONL(file *os.File, data []letterboxd.Result) error {
+	encoder := json.NewEncoder(file)
+	for _, row := range data {
+		if err := encoder.Encode(newJSONResult(row)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeJSON writes the results as a JSON array of objects. The rows
+// are encoded one by one instead of building the whole array first.
+func writeJSON(file *os.File, data []letterboxd.Result) error {
+	if len(data) == 0 {
+		_, err := file.WriteString("[]\n")
+		return err
+	}
+
+	writer := bufio.NewWriter(file)
+	writer.WriteString("[\n")
+	for i, row := range data {
+		encoded, err := json.MarshalIndent(newJSONResult(row), "  ", "  ")
+		if err != nil {
+			return err
+		}
+
+		writer.WriteString("  ")
+		writer.Write(encoded)
+		if i < len(data)-1 {
+			writer.WriteString(",")
+		}
+		if _, err := writer.WriteString("\n"); err != nil {
+			return err
+		}
+	}
+	writer.WriteString("]\n")
+	return writer.Flush()
+}
+
+// ratingHistogram counts the ratings of the merged movies per value,
+// counts[r] is the number of ratings r on the 1-10 scale
+func ratingHistogram(movies []letterboxd.MovieWithRatings) [11]int {
+	var counts [11]int
+	for _, m := range movies {
+		for _, r := range m.Ratings {
+			if r >= 1 && r <= 10 {
+				counts[r]++
+			}
+		}
+	}
+	return counts
+}
+
+// histogramWidth is the length of the longest bar of the histogram
+const histogramWidth = 40
+
+// printHistogram prints the distribution of the ratings as bars, from
+// five stars down to half a star
+func printHistogram(counts [11]int) {
+	total, sum, most := 0, 0, 0
+	for r, count := range counts {
+		total += count
+		sum += r * count
+		most = max(most, count)
+	}
+	if total == 0 {
+		return
+	}
+
+	logger.Infof("Distribution of all %d ratings, %.2f stars on average:\n", total, letterboxd.Stars(float64(sum)/float64(total)))
+	for r := 10; r >= 1; r-- {
+		bar := strings.Repeat("#", counts[r]*histogramWidth/most)
+		logger.Infof("%3.1f %-*s %d\n", letterboxd.Stars(float64(r)), histogramWidth, bar, counts[r])
+	}
+	logger.Infof("\n")
+}
+
+// saveHistogram saves the distribution of the ratings as CSV
+func saveHistogram(filename string, counts [11]int) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	writer := csv.NewWriter(file)
+	writer.Write([]string{"Stars", "Ratings"})
+	for r := 10; r >= 1; r-- {
+		writer.Write([]string{strconv.FormatFloat(letterboxd.Stars(float64(r)), 'f', 1, 64), strconv.Itoa(counts[r])})
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+// readUserList reads a file of newline separated usernames
+func readUserList(filename string) ([]string, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var users []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if user := strings.TrimSpace(scanner.Text()); user != "" {
+			users = append(users, user)
+		}
+	}
+	return users, scanner.Err()
+}
+
+// saveUserList saves usernames to a file, one per line
+func saveUserList(filename string, users []string) error {
+	return os.WriteFile(filename, []byte(strings.Join(users, "\n")+"\n"), 0644)
+}
+
+// friendReport is a friend's line in the -friends-report: the number of
+// films they rated, how many of them were collected and if that failed
+type friendReport struct {
+	User      string
+	Rated     int
+	Collected int
+	Status    string // ok, incomplete or skipped
+	Error     string `json:",omitempty"`
+}
+
+// friendReports reports on every friend, the skipped ones last
+func friendReports(friends []string, skipped []string, movieCounts map[string]int, movies []letterboxd.Movie, incomplete map[string]error) []friendReport {
+	collected := make(map[string]int)
+	for _, m := range movies {
+		collected[m.User]++
+	}
+
+	var report []friendReport
+	used := make(map[string]bool)
+	for _, friend := range friends {
+		used[friend] = true
+		row := friendReport{User: friend, Rated: movieCounts[friend], Collected: collected[friend], Status: "ok"}
+		if err, ok := incomplete[friend]; ok {
+			row.Status, row.Error = "incomplete", err.Error()
+		}
+		report = append(report, row)
+	}
+
+	// Friends without rated films were counted but not used
+	var empty []string
+	for friend := range movieCounts {
+		if !used[friend] {
+			empty = append(empty, friend)
+		}
+	}
+	sort.Strings(empty)
+	for _, friend := range empty {
+		report = append(report, friendReport{User: friend, Status: "skipped", Error: "no rated films"})
+	}
+
+	for _, friend := range skipped {
+		if _, ok := movieCounts[friend]; !ok {
+			report = append(report, friendReport{User: friend, Status: "skipped", Error: "the pages could not be loaded"})
+		}
+	}
+	return report
+}
+
+// saveFriendReports writes the friends report as JSON if the filename
+// ends in .json and as CSV otherwise
+func saveFriendReports(filename string, report []friendReport) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if strings.EqualFold(filepath.Ext(filename), ".json") {
+		encoder := json.NewEncoder(file)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(report)
+	}
+
+	writer := csv.NewWriter(file)
+	writer.Write([]string{"User", "Rated", "Collected", "Status", "Error"})
+	for _, row := range report {
+		writer.Write([]string{row.User, strconv.Itoa(row.Rated), strconv.Itoa(row.Collected), row.Status, row.Error})
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+// readMovieList reads a file of newline separated movie slugs. Both
+// "/film/<slug>/" and a bare "<slug>" are accepted.
+func readMovieList(filename string) ([]string, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var movies []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		slug := movieSlug(strings.TrimSpace(scanner.Text()))
+		if slug != "" {
+			movies = append(movies, "/film/"+slug+"/")
+		}
+	}
+	return movies, scanner.Err()
+}
+
+// notableChange is the change of a movie's average, on the 1-10 scale,
+// that is reported since an earlier run
+const notableChange = 1
+
+// printChanges compares the results with those of an earlier run: the
+// movies that now have at least threshold votes, the ones whose average
+// changed by half a star or more and the ones that no longer have
+// enough votes. At most top movies are listed for each.
+func printChanges(out io.Writer, previous []letterboxd.Result, results []letterboxd.Result, threshold int, top int) {
+	before := make(map[string]letterboxd.Result)
+	for _, r := range previous {
+		before[r.URL] = r
+	}
+	now := make(map[string]bool)
+
+	var added, changed, dropped []letterboxd.Result
+	for _, r := range results {
+		now[r.URL] = true
+		old, existed := before[r.URL]
+		switch {
+		case r.VoteCount < threshold:
+			if existed && old.VoteCount >= threshold {
+				dropped = append(dropped, r)
+			}
+		case !existed || old.VoteCount < threshold:
+			added = append(added, r)
+		case math.Abs(r.AvgRating-old.AvgRating) >= notableChange:
+			changed = append(changed, r)
+		}
+	}
+	for _, r := range previous {
+		if !now[r.URL] && r.VoteCount >= threshold {
+			dropped = append(dropped, r)
+		}
+	}
+
+	byAvg := func(list []letterboxd.Result) {
+		sort.SliceStable(list, func(i, j int) bool {
+			return list[i].AvgRating > list[j].AvgRating
+		})
+	}
+	byAvg(added)
+	byAvg(changed)
+	byAvg(dropped)
+
+	fmt.Fprintf(out, "\n\nSince the earlier run %d movie(s) reached %d vote(s):\n", len(added), threshold)
+	for _, r := range added[:min(len(added), top)] {
+		fmt.Fprintf(out, "%.2f\t%d\t%s\n", letterboxd.Stars(r.AvgRating), r.VoteCount, movieName(r))
+	}
+	fmt.Fprintf(out, "\nThe average of %d movie(s) changed by half a star or more:\n", len(changed))
+	for _, r := range changed[:min(len(changed), top)] {
+		old := before[r.URL]
+		fmt.Fprintf(out, "%.2f -> %.2f\t%s\n", letterboxd.Stars(old.AvgRating), letterboxd.Stars(r.AvgRating), movieName(r))
+	}
+	fmt.Fprintf(out, "\n%d movie(s) no longer have %d vote(s):\n", len(dropped), threshold)
+	for _, r := range dropped[:min(len(dropped), top)] {
+		fmt.Fprintf(out, "%.2f\t%d\t%s\n", letterboxd.Stars(r.AvgRating), r.VoteCount, movieName(r))
+	}
+	fmt.Fprint(out, "\n")
+}
+
+// reportOut is where reports besides the results are printed, stderr
+// if the results are written to stdout
+func reportOut(lb *Letterboxd) io.Writer {
+	if lb.Output == "-" {
+		return os.Stderr
+	}
+	return os.Stdout
+}
+
+// rawRatings holds the merged ratings of a run so they can be reused
+// without scraping them again
+type rawRatings struct {
+	User        string
+	Friends     []string
+	MovieCounts map[string]int
+	Movies      []letterboxd.MovieWithRatings
+}
+
+// saveRawRatings writes the merged ratings to a JSON file
+func saveRawRatings(filename string, raw rawRatings) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return json.NewEncoder(file).Encode(raw)
+}
+
+// loadRawRatings reads merged ratings written by saveRawRatings
+func loadRawRatings(filename string) (rawRatings, error) {
+	var raw rawRatings
+
+	file, err := os.Open(filename)
+	if err != nil {
+		return raw, err
+	}
+	defer file.Close()
+
+	if err := json.NewDecoder(file).Decode(&raw); err != nil {
+		return raw, err
+	}
+	if len(raw.Friends) == 0 {
+		return raw, fmt.Errorf("%s contains no friends", filename)
+	}
+	return raw, nil
+}
+
+// printSimilarities prints the friends from the most to the least
+// similar taste
+func printSimilarities(out io.Writer, friends []string, sims map[string]letterboxd.FriendSimilarity) {
+	// Friends without enough common movies come last
+	score := func(friend string) float64 {
+		if sims[friend].Common < letterboxd.MinCommon {
+			return -2
+		}
+		return sims[friend].Score
+	}
+	sorted := append([]string(nil), friends...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return score(sorted[i]) > score(sorted[j])
+	})
+
+	fmt.Fprintln(out, "\nThe friends rating most like you:")
+	fmt.Fprintln(out, "Similarity\tCommon\tFriend")
+	for _, friend := range sorted {
+		sim := sims[friend]
+		if sim.Common < letterboxd.MinCommon {
+			fmt.Fprintf(out, "-\t\t%d\t%s\n", sim.Common, friend)
+			continue
+		}
+		fmt.Fprintf(out, "%.2f\t\t%d\t%s\n", sim.Score, sim.Common, friend)
+	}
+	fmt.Fprint(out, "\n\n")
+}
+
+// myRatingString formats the user's own rating in stars, "—" if they
+// haven't rated the movie
+func myRatingString(rating int) string {
+	if rating == 0 {
+		return "—"
+	}
+	return strconv.FormatFloat(letterboxd.Stars(float64(rating)), 'f', 1, 64)
+}
+
+// printComparison prints how similar the ratings of two users are, the
+// movies they disagree on most and the best movies only one of them saw
+func printComparison(ctx context.Context, userA string, userB string, c letterboxd.Comparison, top int, metadata bool) {
+	name := func(url string) string {
+		if metadata {
+			if meta, ok := letterboxd.FetchMeta(ctx, url); ok {
+				return movieName(letterboxd.Result{URL: url, Title: meta.Title, Year: meta.Year})
+			}
+		}
+		return slugTitle(movieSlug(url))
+	}
+
+	ratingsA := make([]int, len(c.Both))
+	ratingsB := make([]int, len(c.Both))
+	diff := 0.0
+	for i, p := range c.Both {
+		ratingsA[i], ratingsB[i] = p.RatingA, p.RatingB
+		diff += math.Abs(float64(p.RatingA - p.RatingB))
+	}
+
+	fmt.Printf("\n\n%s and %s both rated %d movie(s).\n", userA, userB, len(c.Both))
+	if len(c.Both) == 0 {
+		return
+	}
+	fmt.Printf("Correlation of their ratings: %.2f\n", letterboxd.Pearson(ratingsA, ratingsB))
+	fmt.Printf("Average difference: %.2f stars\n", letterboxd.Stars(diff/float64(len(c.Both))))
+	fmt.Printf("%d movie(s) only %s rated, %d movie(s) only %s rated.\n", len(c.OnlyA), userA, len(c.OnlyB), userB)
+
+	// Biggest disagreements first
+	pairs := append([]letterboxd.RatedPair(nil), c.Both...)
+	sort.SliceStable(pairs, func(i, j int) bool {
+		return math.Abs(float64(pairs[i].RatingA-pairs[i].RatingB)) > math.Abs(float64(pairs[j].RatingA-pairs[j].RatingB))
+	})
+	fmt.Printf("\nThe movies one loved and the other hated:\n")
+	fmt.Printf("%s\t%s\tTitle\n", userA, userB)
+	shown := 0
+	for _, p := range pairs {
+		loved := max(p.RatingA, p.RatingB) >= letterboxd.LoveRating && min(p.RatingA, p.RatingB) <= letterboxd.HateRating
+		if !loved || shown == top {
+			continue
+		}
+		fmt.Printf("%.1f\t%.1f\t%s\n", letterboxd.Stars(float64(p.RatingA)), letterboxd.Stars(float64(p.RatingB)), name(p.URL))
+		shown++
+	}
+	if shown == 0 {
+		fmt.Println("None, the biggest differences are:")
+		for _, p := range pairs[:min(len(pairs), top)] {
+			fmt.Printf("%.1f\t%.1f\t%s\n", letterboxd.Stars(float64(p.RatingA)), letterboxd.Stars(float64(p.RatingB)), name(p.URL))
+		}
+	}
+
+	for _, only := range []struct {
+		user, other string
+		movies      []letterboxd.Movie
+	}{{userA, userB, c.OnlyA}, {userB, userA, c.OnlyB}} {
+		movies := append([]letterboxd.Movie(nil), only.movies...)
+		sort.SliceStable(movies, func(i, j int) bool {
+			return movies[i].Rating > movies[j].Rating
+		})
+		fmt.Printf("\nThe best movies %s rated and %s didn't:\n", only.user, only.other)
+		for _, m := range movies[:min(len(movies), top)] {
+			fmt.Printf("%.1f\t%s\n", letterboxd.Stars(float64(m.Rating)), name(m.URL))
+		}
+	}
+	fmt.Print("\n\n\n")
+}
+
+// compareUsers collects the ratings of two users and prints how they
+// compare
+func compareUsers(ctx context.Context, lb *Letterboxd) {
+	var users []string
+	for _, user := range lb.Compare {
+		if ok, err := letterboxd.CheckUser(ctx, user); !ok {
+			logger.Errorf("%s\n", letterboxd.UserMessage(user, err))
+			exit(1)
+		}
+		users = append(users, user)
+	}
+
+	scrapeCtx, stop := signal.NotifyContext(ctx, os.Interrupt)
+	movies, incomplete := letterboxd.CollectMoviesParallel(scrapeCtx, users, nil, nil, nil, 0, time.Time{}, time.Time{}, 0)
+	stop()
+	for _, user := range users {
+		if err, ok := incomplete[user]; ok {
+			logger.Warnf("The ratings of \"%s\" are incomplete: %v\n", user, err)
+		}
+	}
+
+	var moviesA, moviesB []letterboxd.Movie
+	for _, m := range movies {
+		if m.User == users[0] {
+			moviesA = append(moviesA, m)
+		} else {
+			moviesB = append(moviesB, m)
+		}
+	}
+	printComparison(ctx, users[0], users[1], letterboxd.CompareRatings(moviesA, moviesB), lb.Top, lb.Metadata)
+}
+
+// errStopped is returned by the confirmation of a run that is stopped
+// before the ratings are collected, e.g. for -dry-run
+var errStopped = errors.New("stopped before collecting the ratings")
+
+// confirmRun returns the Options.Confirm of the command: it lists the
+// friends, prints the estimate of a dry run and asks before collecting
+// many movies
+func confirmRun(lb *Letterboxd, interrupts chan os.Signal) func(run *letterboxd.Run) error {
+	return func(run *letterboxd.Run) error {
+		logger.Infof("\n\nThese eligible users were given:\n")
+		for _, friend := range run.Friends {
+			logger.Infof("%s, %d rated movies\n", friend, run.MovieCounts[friend])
+		}
+		logger.Infof("\n\n\n")
+
+		// Number of movies that will actually be scanned per friend
+		scanCounts := make([]int, len(run.Friends))
+		scanSum := 0
+		for i, friend := range run.Friends {
+			scanCounts[i] = run.MovieCounts[friend]
+			if lb.MaxPerFriend > 0 {
+				scanCounts[i] = min(run.MovieCounts[friend], lb.MaxPerFriend)
+			}
+			scanSum += scanCounts[i]
+		}
+
+		if lb.DryRun {
+			printEstimate(run.Friends, scanCounts)
+			return errStopped
+		}
+
+		// Warning for large number of movies
+		if scanSum > lb.WarnMovies && lb.Interactive && !lb.Yes {
+			pages := letterboxd.TotalPages(scanCounts)
+			fmt.Printf("\n%d movies will be searched with about %d requests.\n", scanSum, pages)
+			fmt.Printf("This could take a while, estimated time: %.1f min.\n", estimateMinutes(pages, lb.PagesPerSecond))
+
+			reader := bufio.NewReader(os.Stdin)
+			fmt.Print("Do you want to start? (y/n)\n")
+			start, _ := reader.ReadString('\n')
+			start = strings.TrimSpace(start)
+
+			if !strings.Contains(start, "y") {
+				return errStopped
+			}
+		}
+
+		// Ctrl-C stops the collection early and keeps what was collected
+		// so far
+		signal.Notify(interrupts, os.Interrupt)
+		return nil
+	}
+}
+
+func main() {
+	lb, set := parseFlags()
+	ctx := context.Background()
+	var deadline time.Time
+	if lb.Deadline > 0 {
+		deadline = time.Now().Add(lb.Deadline)
+	}
+
+	if lb.MetaCache != "" {
+		if err := letterboxd.LoadMetaCache(lb.MetaCache); err != nil {
+			logger.Errorf("Error loading the movie details: %v\n", err)
+			os.Exit(1)
+		}
+		metaCache = lb.MetaCache
+		defer saveMetaCache()
+	}
+
+	// The earlier run is processed with the current settings, so only
+	// new ratings make a difference
+	var previous []letterboxd.Result
+	if lb.SinceRun != "" {
+		raw, err := loadRawRatings(lb.SinceRun)
+		if err != nil {
+			logger.Errorf("Error loading the earlier run: %v\n", err)
+			exit(1)
+		}
+		previous = letterboxd.ProcessResults(letterboxd.FilterRatings(raw.Movies, lb.MinRating), raw.MovieCounts, lb.MinVotes, nil)
+	}
+
+	if len(lb.Compare) > 0 {
+		compareUsers(ctx, lb)
+		return
+	}
+
+	// Use previously saved ratings instead of scraping
+	if lb.LoadRaw != "" {
+		raw, err := loadRawRatings(lb.LoadRaw)
+		if err != nil {
+			logger.Errorf("Error loading ratings: %v\n", err)
+			exit(1)
+		}
+		lb.User = raw.User
+		lb.Friends = raw.Friends
+		logger.Infof("%d unique and rated movies of %d friends are loaded.\n\n", len(raw.Movies), len(raw.Friends))
+
+		lb.MovieCounts = raw.MovieCounts
+		lb.Merged = letterboxd.FilterRatings(raw.Movies, lb.MinRating)
+		results := letterboxd.ProcessResults(lb.Merged, lb.MovieCounts, lb.MinVotes, nil)
+		if threshold := shownThreshold(lb); threshold > 0 {
+			results, _ = enrichFrom(ctx, results, lb, threshold)
+		}
+		if lb.TMDBKey != "" && lb.EnrichedFrom > 0 {
+			letterboxd.AddTMDB(ctx, results, letterboxd.NewTMDB(lb.TMDBKey))
+		}
+		if lb.SinceRun != "" {
+			printChanges(reportOut(lb), previous, results, max(lb.Threshold, 1), lb.Top)
+		}
+		showResults(ctx, results, lb)
+		return
+	}
+
+	var excludeMovies []string
+	if lb.ExcludeFile != "" {
+		var err error
+		excludeMovies, err = readMovieList(lb.ExcludeFile)
+		if err != nil {
+			logger.Errorf("Error reading exclude file: %v\n", err)
+			exit(1)
+		}
+		logger.Infof("%d movies from \"%s\" will be excluded.\n", len(excludeMovies), lb.ExcludeFile)
+	}
+
+	var listMovies []string
+	if lb.List != "" {
+		var err error
+		listMovies, err = letterboxd.GetListMovies(ctx, lb.List)
+		if err != nil {
+			logger.Errorf("Error loading the list: %v\n", err)
+			exit(1)
+		}
+		if len(listMovies) == 0 {
+			logger.Errorf("The list has no movies.\n")
+			exit(1)
+		}
+		logger.Infof("%d movies from the list will be ranked.\n", len(listMovies))
+	}
+
+	// Get user and friends
+	if lb.User == "" {
+		lb.User = getUser(ctx)
+		lb.Users = []string{lb.User}
+	}
+	for _, user := range lb.Users {
+		if ok, err := letterboxd.CheckUser(ctx, user); !ok {
+			logger.Errorf("%s\n", letterboxd.UserMessage(user, err))
+			exit(1)
+		}
+	}
+
+	// Saved friends were checked when they were generated
+	fromFile := false
+	if lb.FriendsFile != "" && len(lb.Friends) == 0 {
+		saved, err := readUserList(lb.FriendsFile)
+		if err != nil {
+			logger.Errorf("Error reading friends file: %v\n", err)
+			exit(1)
+		}
+		lb.Friends, fromFile = letterboxd.Dedupe(saved), true
+		logger.Infof("%d friends are loaded from \"%s\".\n", len(lb.Friends), lb.FriendsFile)
+	}
+	if len(lb.Friends) > 0 && !fromFile {
+		logger.Infof("\nThe given users are checked...\n")
+		lb.Friends = letterboxd.CheckFriends(ctx, letterboxd.Dedupe(lb.Friends))
+		if len(lb.Friends) == 0 {
+			logger.Errorf("\nNo user was found!\n")
+			if !lb.Interactive {
+				exit(1)
+			}
+		}
+	}
+	if len(lb.Friends) == 0 {
+		if lb.Interactive {
+			network := ""
+			if set["network"] {
+				network = lb.Network
+			}
+			lb.Friends = getFriends(ctx, lb.Users, network)
+		} else {
+			logger.Infof("The friends list is generated...\n")
+			var err error
+			lb.Friends, err = letterboxd.FindNetworks(ctx, lb.Users, lb.Network)
+			if err != nil {
+				logger.Errorf("\nThe friends list could not be loaded completely: %v\n", err)
+				exit(1)
+			}
+			if len(lb.Friends) == 0 {
+				logger.Errorf("\nNo user was found!\n")
+				exit(1)
+			}
+		}
+	}
+	lb.Friends = letterboxd.WithoutUsers(letterboxd.Dedupe(lb.Friends), lb.Users...)
+	if len(lb.Friends) == 0 {
+		logger.Errorf("\nNo user besides you was found!\n")
+		exit(1)
+	}
+	if lb.Depth == 2 {
+		question := fmt.Sprintf("\nAdding the friends of your %d friends needs at least %d more requests and may add up to %d users. Continue (y/n)?", len(lb.Friends), len(lb.Friends), letterboxd.MaxNetwork)
+		if !lb.Interactive || lb.Yes || askYesNo(question) {
+			lb.Friends = letterboxd.ExpandFriends(ctx, lb.Users, lb.Friends)
+		}
+	}
+	if len(lb.Friends) < lb.MinFriends {
+		if lb.Interactive && !lb.Yes {
+			lb.Friends = addMoreFriends(ctx, lb.Users, lb.Friends, lb.MinFriends)
+		} else {
+			logger.Warnf("Only %d friend(s) are used, the averages are just their ratings and say little about a group.\n", len(lb.Friends))
+		}
+	}
+	if lb.SaveFriends != "" {
+		if err := saveUserList(lb.SaveFriends, lb.Friends); err != nil {
+			logger.Errorf("Error saving friends: %v\n", err)
+		} else {
+			logger.Infof("The friends are saved to \"%s\".\n", lb.SaveFriends)
+		}
+	}
+
+	// Check if user wants to exclude their watched movies
+	if lb.Interactive && !lb.DryRun && !set["exclude-watched"] {
+		lb.ExcludeWatched = askExcludeWatched()
+	}
+
+	// Pages that failed, e.g. while rate limited, can be tried again
+	retry := func(skipped []string) bool {
+		return lb.Interactive && askYesNo(fmt.Sprintf("\n%d friend(s) could not be loaded: %s. Try them again (y/n)?", len(skipped), strings.Join(skipped, ", ")))
+	}
+	stop := make(chan struct{})
+	interrupts := make(chan os.Signal, 1)
+	go func() {
+		<-interrupts
+		// A second Ctrl-C ends the program
+		signal.Stop(interrupts)
+		close(stop)
+	}()
+
+	run := &letterboxd.Run{}
+	results, err := letterboxd.AggregateContext(ctx, lb.User, letterboxd.Options{
+		Group:          lb.Users[1:],
+		Friends:        lb.Friends,
+		ExcludeWatched: lb.ExcludeWatched,
+		ExcludeMovies:  excludeMovies,
+		IncludeMovies:  listMovies,
+		MaxPerFriend:   lb.MaxPerFriend,
+		MinRating:      lb.MinRating,
+		MinVotes:       lb.MinVotes,
+		Since:          lb.Since,
+		Until:          lb.Until,
+		Similarity:     lb.Similarity,
+		MyRatings:      lb.ShowMine,
+		KeepEmpty:      !lb.SkipEmpty,
+		Deadline:       deadline,
+		Stop:           stop,
+		Retry:          retry,
+		Confirm:        confirmRun(lb, interrupts),
+		Run:            run,
+	})
+	signal.Stop(interrupts)
+	if errors.Is(err, errStopped) {
+		return
+	}
+	if err != nil {
+		logger.Errorf("\n%s\n", err)
+		exit(1)
+	}
+	lb.Friends = run.Friends
+	lb.MovieCounts = run.MovieCounts
+	lb.Skipped = run.Skipped
+	lb.Truncated = run.Truncated
+	lb.Movies = run.Movies
+	lb.MyMovies = run.Watched
+	lb.MyRatings = run.MyRatings
+	lb.Similarities = run.Similarities
+
+	if lb.FriendsReport != "" {
+		report := friendReports(lb.Friends, lb.Skipped, lb.MovieCounts, lb.Movies, run.Incomplete)
+		if err := saveFriendReports(lb.FriendsReport, report); err != nil {
+			logger.Errorf("Error saving the friends report: %v\n", err)
+		} else {
+			logger.Infof("The friends report is saved to \"%s\".\n\n", lb.FriendsReport)
+		}
+	}
+
+	if lb.Similarity {
+		printSimilarities(reportOut(lb), lb.Friends, lb.Similarities)
+	}
+
+	counts := ratingHistogram(run.Merged)
+	printHistogram(counts)
+	if lb.Histogram != "" {
+		if err := saveHistogram(lb.Histogram, counts); err != nil {
+			logger.Errorf("Error saving the rating distribution: %v\n", err)
+		}
+	}
+
+	if lb.SaveRaw != "" {
+		raw := rawRatings{User: lb.User, Friends: lb.Friends, MovieCounts: lb.MovieCounts, Movies: run.Merged}
+		if err := saveRawRatings(lb.SaveRaw, raw); err != nil {
+			logger.Errorf("Error saving ratings: %v\n", err)
+		} else {
+			logger.Infof("The merged ratings are saved to \"%s\".\n\n", lb.SaveRaw)
+		}
+	}
+
+	lb.Merged = letterboxd.FilterRatings(run.Merged, lb.MinRating)
+	if threshold := shownThreshold(lb); threshold > 0 {
+		results, _ = enrichFrom(ctx, results, lb, threshold)
+	}
+	if lb.TMDBKey != "" && lb.EnrichedFrom > 0 {
+		letterboxd.AddTMDB(ctx, results, letterboxd.NewTMDB(lb.TMDBKey))
+	}
+	if lb.SinceRun != "" {
+		printChanges(reportOut(lb), previous, results, max(lb.Threshold, 1), lb.Top)
+	}
+	showResults(ctx, results, lb)
 }
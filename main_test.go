@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/csv"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/birthtothunder/Letterboxd-Top-Movies-as-Rated-by-Friends/letterboxd"
+)
+
+// tempFile creates an empty file in the test's temporary directory
+func tempFile(t *testing.T, name string) *os.File {
+	t.Helper()
+	file, err := os.Create(filepath.Join(t.TempDir(), name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { file.Close() })
+	return file
+}
+
+func TestTMDBURL(t *testing.T) {
+	tests := []struct {
+		kind string
+		id   int
+		want string
+	}{
+		{"movie", 0, ""},
+		{"tv", 0, ""},
+		{"", 603, "https://www.themoviedb.org/movie/603"},
+		{"movie", 603, "https://www.themoviedb.org/movie/603"},
+		{"tv", 1396, "https://www.themoviedb.org/tv/1396"},
+	}
+	for _, tt := range tests {
+		if got := tmdbURL(tt.kind, tt.id); got != tt.want {
+			t.Errorf("tmdbURL(%q, %d) = %q, want %q", tt.kind, tt.id, got, tt.want)
+		}
+	}
+}
+
+func TestWriteHTMLTMDBLinks(t *testing.T) {
+	file := tempFile(t, "report.html")
+	results := []letterboxd.Result{
+		{URL: "/film/the-matrix/", Ratings: []int{9}, VoteCount: 1, TMDBID: 603, TMDBType: "movie"},
+		{URL: "/film/breaking-bad/", Ratings: []int{10}, VoteCount: 1, TMDBID: 1396, TMDBType: "tv"},
+	}
+	if err := writeHTML(file, results, 1); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(file.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, link := range []string{"https://www.themoviedb.org/movie/603", "https://www.themoviedb.org/tv/1396"} {
+		if !strings.Contains(string(data), link) {
+			t.Errorf("the report has no link to %s", link)
+		}
+	}
+}
+
+func TestWriteCSVHeader(t *testing.T) {
+	file := tempFile(t, "results.csv")
+	results := []letterboxd.Result{
+		{URL: "/film/the-matrix/", Title: "The Matrix", Ratings: []int{9, 10}, Raters: []string{"anna", "ben"}, VoteCount: 2},
+	}
+	if err := writeCSV(file, results, 1, "bayes"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := file.Seek(0, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	// The title is a row of its own, the header and rows are wider
+	reader := csv.NewReader(file)
+	reader.FieldsPerRecord = -1
+	records, err := reader.ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 3 {
+		t.Fatalf("got %d records, want the title, the header and one row", len(records))
+	}
+	header := records[1]
+	if len(header) != 21 || header[0] != "Bayesian Rating" || header[13] != "Movie" || header[20] != "TMDB URL" {
+		t.Errorf("the header has %d fields %q, want 21 from \"Bayesian Rating\" to \"TMDB URL\"", len(header), header)
+	}
+	if len(records[2]) != len(header) {
+		t.Errorf("the row has %d fields, the header %d", len(records[2]), len(header))
+	}
+	if records[2][13] != "/film/the-matrix/" {
+		t.Errorf("the movie column holds %q", records[2][13])
+	}
+}
+
+func TestParseConfigValue(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{`"anna" # me`, "anna"},
+		{`"#1 fan"`, "#1 fan"},
+		{`'#1 fan' # literal`, "#1 fan"},
+		{`'C:\films\' # literal`, `C:\films\`},
+		{`["anna", 'ben#2'] # friends`, "anna,ben#2"},
+		{`4.5 # stars`, "4.5"},
+	}
+	for _, tt := range tests {
+		got, err := parseConfigValue(tt.value)
+		if err != nil {
+			t.Errorf("parseConfigValue(%q) failed: %v", tt.value, err)
+		} else if got != tt.want {
+			t.Errorf("parseConfigValue(%q) = %q, want %q", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestDatedFilename(t *testing.T) {
+	morning := time.Date(2024, 6, 1, 8, 30, 0, 0, time.UTC)
+	tests := []struct {
+		format  string
+		started time.Time
+		want    string
+	}{
+		{"", morning, "results-2024-06-01-083000.csv"},
+		{"letterboxd", morning, "results-2024-06-01-083000.csv"},
+		{"jsonl", morning, "results-2024-06-01-083000.jsonl"},
+		{"csv", morning.Add(time.Second), "results-2024-06-01-083001.csv"},
+	}
+	for _, tt := range tests {
+		if got := datedFilename("runs", tt.format, tt.started); got != filepath.Join("runs", tt.want) {
+			t.Errorf("datedFilename(%q, %v) = %q, want %q", tt.format, tt.started, got, filepath.Join("runs", tt.want))
+		}
+	}
+}